@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"flag"
 	"fmt"
+	"log"
 	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
+
+	"snake/wfc"
 )
 
 var bgColor = rl.NewColor(128, 160, 107, 255)
@@ -52,6 +61,14 @@ var levelSpeed = map[string]float64{
 	Level2: 0.09,
 	Level3: 0.0625,
 }
+
+// terrainSpeed scales the time between two moves while the head of the
+// snake is on a tile: forest slows it down, sand speeds it up
+var terrainSpeed = map[wfc.Tile]float64{
+	wfc.Forest: 1.5,
+	wfc.Sand:   0.7,
+}
+
 var levelSkipScore = []struct {
 	string
 	uint32
@@ -61,6 +78,23 @@ var levelSkipScore = []struct {
 	{Level1, 0},
 }
 
+type Mode = string
+
+const (
+	// the border kills
+	ModeClassic string = "CLASSIC"
+	// no walls, the snake comes back in from the opposite side and the
+	// terrain tiles seamlessly
+	ModeWrap string = "WRAP"
+	// like classic, but the tides keep reshaping the coast
+	ModeTides string = "TIDES"
+	// no border at all, the world is generated around the snake as it
+	// goes
+	ModeEndless string = "ENDLESS"
+)
+
+var modes = []string{ModeClassic, ModeWrap, ModeTides, ModeEndless}
+
 type Snake struct {
 	pieces         [][]int32
 	direction      int8
@@ -71,6 +105,7 @@ type Snake struct {
 	paused   bool
 	gameOver bool
 	level    Level
+	mode     Mode
 }
 
 type Food struct {
@@ -108,102 +143,323 @@ func randUInt32Between(min, max uint32) int32 {
 	return int32(u + min)
 }
 
-var wfcPlane, startingPos = wfcInit(width/step-offsetX*2, height/step-offsetY*3)
+const planeWidth = width/step - offsetX*2
+const planeHeight = height/step - offsetY*3
+
+var wfcPlane wfc.Plane
+var decorPlane wfc.Plane
+
+// endless is the world of the endless mode, wfcPlane and decorPlane are
+// nil while it is played
+var endless *world
+
+var startingPos []int32
+var seed int64
+
+// mapMode and mapLevel are the game mode and level the current map was
+// generated for
+var mapMode Mode
+var mapLevel Level
+
+// mapMetrics describes the current map for the debug overlay toggled with
+// F3, it is not kept up to date in the endless mode
+var mapMetrics wfc.Metrics
+var showMetrics bool
+
+// notice is a message shown at the top of the screen for noticeDuration
+// seconds after noticeTime
+var notice string
+var noticeTime float64
+
+const noticeDuration = 5
 
 var oceanAnimationLastUpdated = 0.0
 var oceanAnimationFlip = false
 
 var snake = Snake{
-	pieces: [][]int32{
-		{
-			startingPos[1] + offsetX, // x pos
-			startingPos[0] + offsetY, // y pos
-		},
-	},
 	direction: Right,
 	score:     0,
 	paused:    true,
 	started:   false,
 	gameOver:  false,
 	level:     Level1,
+	mode:      ModeClassic,
 }
 
 //go:embed assets/Minecraft.ttf
 var fontData []byte
 
 func main() {
+	// maps can be generated without opening a window, see mapgen
+	if len(os.Args) > 1 && os.Args[1] == "mapgen" {
+		os.Exit(mapgen(os.Args[2:]))
+	}
+
+	flag.Parse()
+	// a saved map is played on with the style it was generated with
+	var saved savedMap
+	if *mapFlag != "" {
+		var err error
+		if saved, err = readMapFile(*mapFlag); err != nil {
+			log.Fatal(err)
+		}
+		if err := saved.useStyle(); err != nil {
+			log.Fatalf("%s: %v", *mapFlag, err)
+		}
+	}
+	if err := learnStyle(); err != nil {
+		log.Fatal(err)
+	}
+
+	// seedInput is the seed being typed in the menu
+	var seedInput string
+
+	// visual is set while the generation of a map is being watched
+	var visual *visualisation
+
+	// tideRand picks where the tides of the current map come in and how,
+	// so they follow from its seed
+	var tideRand *rand.Rand
+
+	useMap := func(m generatedMap) {
+		seed = m.seed
+		mapMode = m.mode
+		mapLevel = m.level
+		tideRand = rand.New(rand.NewSource(levelSeed(m.seed, m.level)))
+		seedInput = strconv.FormatInt(m.seed, 10)
+		if endless != nil {
+			endless.close()
+			endless = nil
+		}
+		if m.mode == ModeEndless {
+			endless = newWorld(levelSeed(m.seed, m.level), terrains[m.level])
+			wfcPlane, decorPlane, startingPos = nil, nil, endless.spawn
+			return
+		}
+		wfcPlane, decorPlane, startingPos = m.plane, m.decorations, m.pos
+
+		if m.err != nil {
+			log.Printf("seed %d: %v", m.seed, m.err)
+			wfcPlane, decorPlane, startingPos = fallbackMap()
+			notice = fmt.Sprintf("NO MAP FOR SEED %d, USING FALLBACK", m.seed)
+			noticeTime = rl.GetTime()
+		}
+		mapMetrics = measureMap(wfcPlane, decorPlane, mapMode)
+	}
+
+	// loadMap generates the map for a specific seed right away
+	loadMap := func(s int64, mode Mode, level Level) {
+		m := generatedMap{seed: s, mode: mode, level: level}
+		if mode != ModeEndless {
+			m.plane, m.decorations, m.pos, m.err = wfcInit(context.Background(), planeWidth, planeHeight, s, mode, level)
+		}
+		useMap(m)
+	}
+
+	// maps for random seeds are generated ahead of time, for every mode
+	// and level that has been played. warmPool starts generating them as
+	// soon as a game is played on them, so they are ready by its end
+	pools := make(map[[2]string]*mapPool)
+	warmPool := func(mode Mode, level Level) *mapPool {
+		// the world generates itself as it is played
+		if mode == ModeEndless {
+			return nil
+		}
+		key := [2]string{mode, level}
+		if pools[key] == nil {
+			pools[key] = newMapPool(planeWidth, planeHeight, mode, level)
+		}
+		return pools[key]
+	}
+	nextMap := func(mode Mode, level Level) generatedMap {
+		if mode == ModeEndless {
+			return generatedMap{seed: newSeed(), mode: mode, level: level}
+		}
+		return warmPool(mode, level).next()
+	}
+	defer func() {
+		for _, p := range pools {
+			p.close()
+		}
+	}()
+
 	rl.InitWindow(width, height, "retro snake")
 	defer rl.CloseWindow()
 	rl.SetTargetFPS(60)
 
+	if *mapFlag != "" {
+		m, err := saved.generatedMap()
+		if err != nil {
+			log.Fatalf("%s: %v", *mapFlag, err)
+		}
+		if m.plane.Width() != planeWidth || m.plane.Height() != planeHeight {
+			log.Fatalf("%s: map is %dx%d, want %dx%d", *mapFlag, m.plane.Width(), m.plane.Height(), planeWidth, planeHeight)
+		}
+		snake.mode, snake.level = m.mode, m.level
+		useMap(m)
+	} else if *seedFlag != 0 {
+		loadMap(*seedFlag, snake.mode, snake.level)
+	} else {
+		useMap(nextMap(snake.mode, snake.level))
+	}
+	snake.pieces = [][]int32{
+		{
+			startingPos[1] + offsetX, // x pos
+			startingPos[0] + offsetY, // y pos
+		},
+	}
+
 	font := rl.LoadFontFromMemory(".ttf", fontData, int32(len(fontData)), 32, nil, 255)
 	defer rl.UnloadFont(font)
 
 	var maxScore uint32 = 0
 
-	drawGrid := func() {
-		rl.DrawRectangleV(bd.top, bd.horizontalThickness, snakeColor)
-		rl.DrawRectangleV(bd.bottom, bd.horizontalThickness, snakeColor)
-		rl.DrawRectangleV(bd.left, bd.verticalThickness, snakeColor)
-		rl.DrawRectangleV(bd.right, bd.verticalThickness, snakeColor)
+	// draws the tile of the plane cell at (x, y)
+	drawTile := func(x, y int, tile wfc.Tile) {
+		xp := float32((x + offsetX) * step)
+		yp := float32((y + offsetY) * step)
+
+		switch tile {
+		case wfc.Land:
+			// land
+		case wfc.Coast:
+			c := 4
+			incr := float32(step) / float32(c)
+
+			for ix := 1; ix < c; ix++ {
+				xx := xp + float32(ix)*incr
+				for iy := 1; iy < c; iy++ {
+					yy := yp + float32(iy)*incr
+					rl.DrawCircleV(rl.NewVector2(xx, yy), 1, rl.Black)
+				}
+			}
+		case wfc.Sand:
+			// fewer grains than the coast
+			rl.DrawCircleV(rl.NewVector2(xp+step/4, yp+step/4), 1, rl.Black)
+			rl.DrawCircleV(rl.NewVector2(xp+3*step/4, yp+step/2), 1, rl.Black)
+			rl.DrawCircleV(rl.NewVector2(xp+step/4, yp+3*step/4), 1, rl.Black)
+		case wfc.Forest:
+			// a small and a big fir
+			rl.DrawTriangle(
+				rl.NewVector2(xp+step/4, yp+step/4),
+				rl.NewVector2(xp, yp+3*step/4),
+				rl.NewVector2(xp+step/2, yp+3*step/4),
+				snakeColor,
+			)
+			rl.DrawTriangle(
+				rl.NewVector2(xp+2*step/3, yp),
+				rl.NewVector2(xp+step/3, yp+step),
+				rl.NewVector2(xp+step, yp+step),
+				snakeColor,
+			)
+		case wfc.Rock:
+			rl.DrawCircleSector(rl.NewVector2(xp+step/2, yp+step), step/2, 180, 360, 0, rl.DarkGray)
+			rl.DrawCircleSector(rl.NewVector2(xp+step/4, yp+step), step/4, 180, 360, 0, rl.Gray)
+		case wfc.River:
+			// ripples drifting with the waves of the sea
+			shift := float32(0)
+			if oceanAnimationFlip {
+				shift = step / 4
+			}
+			for _, yy := range []float32{yp + step/3, yp + 2*step/3} {
+				rl.DrawLineV(rl.NewVector2(xp+shift, yy), rl.NewVector2(xp+shift+step/2, yy), rl.Black)
+				shift = step/4 - shift
+			}
+		case wfc.Bridge:
+			// planks between two rails
+			rl.DrawRectangleLinesEx(rl.NewRectangle(xp+1, yp+1, step-2, step-2), 2, rl.Brown)
+			for yy := yp + step/3; yy < yp+step-2; yy += step / 3 {
+				rl.DrawLineV(rl.NewVector2(xp+1, yy), rl.NewVector2(xp+step-1, yy), rl.Brown)
+			}
+		default:
+			// sea
+			if oceanAnimationFlip {
+				xs := []float32{
+					xp, xp + step/2, xp + step,
+				}
 
-		if snake.started {
-			if rl.GetTime()-oceanAnimationLastUpdated > 0.6 {
-				oceanAnimationFlip = !oceanAnimationFlip
-				oceanAnimationLastUpdated = rl.GetTime()
+				ys := []float32{
+					yp + step/4, yp + (step - step/4), yp + step/4,
+				}
+
+				for i := 0; i < len(xs)-1; i++ {
+					rl.DrawLineV(rl.NewVector2(xs[i], ys[i]), rl.NewVector2(xs[i+1], ys[i+1]), rl.Black)
+				}
+			} else {
+				xs := []float32{
+					xp, xp + (step / 4), xp + 3*(step/4), xp + step,
+				}
+
+				ys := []float32{
+					yp + step/2, yp + step/4, yp + (step - step/4), yp + step/2,
+				}
+
+				for i := 0; i < len(xs)-1; i++ {
+					rl.DrawLineV(rl.NewVector2(xs[i], ys[i]), rl.NewVector2(xs[i+1], ys[i+1]), rl.Black)
+				}
+			}
+		}
+	}
+
+	// draws the decoration over the plane cell at (x, y)
+	drawDecoration := func(x, y int, decoration wfc.Tile) {
+		xp := float32((x + offsetX) * step)
+		yp := float32((y + offsetY) * step)
+
+		switch decoration {
+		case wfc.Tree:
+			rl.DrawRectangleV(rl.NewVector2(xp+step/2-1, yp+step/2), rl.NewVector2(2, step/2), rl.DarkBrown)
+			rl.DrawCircleV(rl.NewVector2(xp+step/2, yp+step/3), step/3, snakeColor)
+		case wfc.Boulder:
+			rl.DrawCircleV(rl.NewVector2(xp+step/2, yp+step/2), step/3, rl.Gray)
+			rl.DrawCircleV(rl.NewVector2(xp+step/2-2, yp+step/2-2), 2, rl.LightGray)
+		case wfc.Shell:
+			rl.DrawCircleSector(rl.NewVector2(xp+step/2, yp+2*step/3), step/4, 180, 360, 0, rl.Pink)
+		case wfc.Hut:
+			rl.DrawRectangleV(rl.NewVector2(xp+step/4, yp+step/2), rl.NewVector2(step/2, step/2), rl.Brown)
+			rl.DrawTriangle(
+				rl.NewVector2(xp+step/2, yp),
+				rl.NewVector2(xp, yp+step/2),
+				rl.NewVector2(xp+step, yp+step/2),
+				rl.DarkBrown,
+			)
+		}
+	}
+
+	drawGrid := func() {
+		if snake.mode == ModeWrap || snake.mode == ModeEndless {
+			// dashed, the snake goes through it
+			dash := rl.NewVector2(step/2, borderThickness)
+			for x := border.X; x < border.X+border.Width; x += step {
+				rl.DrawRectangleV(rl.NewVector2(x+step/4, bd.top.Y), dash, snakeColor)
+				rl.DrawRectangleV(rl.NewVector2(x+step/4, bd.bottom.Y), dash, snakeColor)
+			}
+			dash = rl.NewVector2(borderThickness, step/2)
+			for y := border.Y; y < border.Y+border.Height; y += step {
+				rl.DrawRectangleV(rl.NewVector2(bd.left.X, y+step/4), dash, snakeColor)
+				rl.DrawRectangleV(rl.NewVector2(bd.right.X, y+step/4), dash, snakeColor)
 			}
+		} else {
+			rl.DrawRectangleV(bd.top, bd.horizontalThickness, snakeColor)
+			rl.DrawRectangleV(bd.bottom, bd.horizontalThickness, snakeColor)
+			rl.DrawRectangleV(bd.left, bd.verticalThickness, snakeColor)
+			rl.DrawRectangleV(bd.right, bd.verticalThickness, snakeColor)
+		}
+
+		if rl.GetTime()-oceanAnimationLastUpdated > 0.6 {
+			oceanAnimationFlip = !oceanAnimationFlip
+			oceanAnimationLastUpdated = rl.GetTime()
+		}
 
+		if snake.started {
 			for y, row := range wfcPlane {
 				for x, tile := range row {
-					if tile[0] == 'L' {
-						// land
-					} else if tile[0] == 'C' {
-						// coast
-						xp := float32((x + offsetX) * step)
-						yp := float32((y + offsetY) * step)
-
-						c := 4
-						incr := float32(step) / float32(c)
-
-						for ix := 1; ix < c; ix++ {
-							xx := xp + float32(ix)*incr
-							for iy := 1; iy < c; iy++ {
-								yy := yp + float32(iy)*incr
-								rl.DrawCircleV(rl.NewVector2(xx, yy), 1, rl.Black)
-							}
-						}
-
-					} else {
-						// sea
-						xp := float32((x + offsetX) * step)
-						yp := float32((y + offsetY) * step)
-
-						if oceanAnimationFlip {
-							xs := []float32{
-								xp, xp + step/2, xp + step,
-							}
-
-							ys := []float32{
-								yp + step/4, yp + (step - step/4), yp + step/4,
-							}
-
-							for i := 0; i < len(xs)-1; i++ {
-								rl.DrawLineV(rl.NewVector2(xs[i], ys[i]), rl.NewVector2(xs[i+1], ys[i+1]), rl.Black)
-							}
-						} else {
-							xs := []float32{
-								xp, xp + (step / 4), xp + 3*(step/4), xp + step,
-							}
-
-							ys := []float32{
-								yp + step/2, yp + step/4, yp + (step - step/4), yp + step/2,
-							}
-
-							for i := 0; i < len(xs)-1; i++ {
-								rl.DrawLineV(rl.NewVector2(xs[i], ys[i]), rl.NewVector2(xs[i+1], ys[i+1]), rl.Black)
-							}
-						}
-					}
+					drawTile(x, y, tile)
+				}
+			}
+			for y, row := range decorPlane {
+				for x, decoration := range row {
+					drawDecoration(x, y, decoration)
 				}
 			}
 		}
@@ -326,16 +582,26 @@ func main() {
 				py := prev[1]
 				var direction int8
 
-				if px > x {
+				// pieces further apart than one cell are on both sides of
+				// a wrapping border
+				dx, dy := px-x, py-y
+				if dx > 1 || dx < -1 {
+					dx = -dx
+				}
+				if dy > 1 || dy < -1 {
+					dy = -dy
+				}
+
+				if dx > 0 {
 					direction = Right
 				}
-				if px < x {
+				if dx < 0 {
 					direction = Left
 				}
-				if py > y {
+				if dy > 0 {
 					direction = Down
 				}
-				if py < y {
+				if dy < 0 {
 					direction = Up
 				}
 
@@ -405,14 +671,44 @@ func main() {
 		return !rl.CheckCollisionRecs(rHead, border)
 	}
 
-	drowns := func(head []int32) bool {
-		x := head[0]
-		y := head[1]
-		return wfcPlane[y-offsetY][x-offsetX][0] == 'S'
+	// brings a position that left the board back in from the opposite side
+	wrapAround := func(p []int32) []int32 {
+		x := (p[0]-offsetX+planeWidth)%planeWidth + offsetX
+		y := (p[1]-offsetY+planeHeight)%planeHeight + offsetY
+		return []int32{x, y}
+	}
+
+	// the loaded map decides, the mode picked in the menu may not be
+	// loaded yet
+	tileAt := func(p []int32) wfc.Tile {
+		if endless != nil {
+			return endless.tile(int(p[0]-offsetX), int(p[1]-offsetY))
+		}
+		return wfcPlane[p[1]-offsetY][p[0]-offsetX]
+	}
+
+	decorationAt := func(p []int32) wfc.Tile {
+		if endless != nil {
+			return endless.decoration(int(p[0]-offsetX), int(p[1]-offsetY))
+		}
+		if decorPlane == nil {
+			return wfc.Empty
+		}
+		return decorPlane[p[1]-offsetY][p[0]-offsetX]
+	}
+
+	// the sea and rivers drown the snake, rocks and solid decorations
+	// kill it
+	crashes := func(head []int32) bool {
+		return !wfc.Passable(tileAt(head)) || solid(decorationAt(head))
 	}
 
 	updateSnake := func() {
-		if rl.GetTime()-snake.lastUpdateTime < levelSpeed[snake.level] {
+		delay := levelSpeed[snake.level]
+		if f, ok := terrainSpeed[tileAt(snake.pieces[0])]; ok {
+			delay *= f
+		}
+		if rl.GetTime()-snake.lastUpdateTime < delay {
 			return
 		}
 
@@ -421,8 +717,15 @@ func main() {
 		y := head[1]
 
 		newHeadPosition := nextHeadPosition(x, y)
+		if snake.mode == ModeWrap {
+			newHeadPosition = wrapAround(newHeadPosition)
+		}
+		if snake.mode == ModeEndless && !endless.ready(int(newHeadPosition[0]-offsetX), int(newHeadPosition[1]-offsetY)) {
+			// wait for the chunk ahead to be generated
+			return
+		}
 
-		if outOfBounds(newHeadPosition) || eatsItself(newHeadPosition) || drowns(newHeadPosition) {
+		if (snake.mode != ModeEndless && outOfBounds(newHeadPosition)) || eatsItself(newHeadPosition) || crashes(newHeadPosition) {
 			snake.gameOver = true
 			return
 		}
@@ -446,6 +749,7 @@ func main() {
 			if maxScore > v.uint32 {
 				if slices.Index(levels, snake.level) < slices.Index(levels, v.string) {
 					snake.level = v.string
+					warmPool(snake.mode, snake.level)
 				}
 				break
 			}
@@ -455,7 +759,91 @@ func main() {
 		snake.lastUpdateTime = rl.GetTime()
 	}
 
+	// the snake, the cell it moves to next and the food stay on dry land
+	tideKeep := func() [][]int32 {
+		head := snake.pieces[0]
+		keep := append([][]int32{}, snake.pieces...)
+		keep = append(keep, nextHeadPosition(head[0], head[1]))
+		if food != nil {
+			keep = append(keep, []int32{food.x, food.y})
+		}
+		for i, p := range keep {
+			keep[i] = []int32{p[0] - offsetX, p[1] - offsetY}
+		}
+		return keep
+	}
+
+	// the tide turns every tideInterval seconds of play. it comes in in the
+	// background and is only swapped in if what it kept dry still is
+	tideTime := 0.0
+	var pendingTide <-chan tideResult
+	updateTides := func() {
+		select {
+		case r := <-pendingTide:
+			pendingTide = nil
+			switch {
+			case r.err != nil:
+				log.Printf("tide: %v", r.err)
+			case snake.mode != ModeTides || len(wfcPlane) == 0 || &r.from[0] != &wfcPlane[0]:
+				// a new map came up while the tide was coming in
+			case !dry(r.terrain, r.decorations, tideKeep()):
+				log.Printf("tide: the snake or its food moved under water")
+			default:
+				wfcPlane, decorPlane = r.terrain, r.decorations
+				mapMetrics = measureMap(wfcPlane, decorPlane, mapMode)
+			}
+		default:
+		}
+
+		if snake.mode != ModeTides || !snake.started || snake.paused || snake.gameOver {
+			tideTime = rl.GetTime()
+			return
+		}
+		if pendingTide != nil || rl.GetTime()-tideTime < tideInterval {
+			return
+		}
+		tideTime = rl.GetTime()
+		pendingTide = startTide(tideRand, terrains[mapLevel], wfcPlane, decorPlane, tideKeep(), mapStyles[*mapStyleFlag].minReachable)
+	}
+
+	// saveCurrentMap keeps the current map, as it is now, in savedMapsDir
+	saveCurrentMap := func() {
+		m := generatedMap{seed: seed, mode: mapMode, level: mapLevel, plane: wfcPlane, decorations: decorPlane, pos: startingPos}
+		name := filepath.Join(savedMapsDir, fmt.Sprintf("%s-%d", strings.ToLower(mapMode), seed))
+		err := os.MkdirAll(savedMapsDir, 0o755)
+		for _, ext := range []string{".json", ".txt", ".png"} {
+			if err == nil {
+				err = saveMap(name+ext, m)
+			}
+		}
+		if err != nil {
+			log.Print(err)
+			notice = "COULD NOT SAVE THE MAP"
+		} else {
+			notice = "MAP SAVED TO " + strings.ToUpper(name)
+		}
+		noticeTime = rl.GetTime()
+	}
+
 	grabKeyPresses := func() {
+		if rl.IsKeyPressed(rl.KeyF2) && visual == nil && mapMode != ModeEndless {
+			saveCurrentMap()
+		}
+		if rl.IsKeyPressed(rl.KeyF3) {
+			showMetrics = !showMetrics
+		}
+
+		if visual != nil {
+			if rl.IsKeyPressed(rl.KeyV) || rl.IsKeyPressed(rl.KeyEnter) {
+				visual.close()
+				visual = nil
+			}
+			// enter goes on to start the game on the seed just watched
+			if !rl.IsKeyPressed(rl.KeyEnter) {
+				return
+			}
+		}
+
 		if snake.started {
 			direction := snake.direction
 			if rl.IsKeyDown(rl.KeyLeft) {
@@ -482,7 +870,7 @@ func main() {
 
 		if rl.IsKeyPressed(rl.KeyEnter) {
 			if snake.gameOver {
-				wfcPlane, startingPos = wfcInit(width/step-4, height/step-6)
+				useMap(nextMap(snake.mode, snake.level))
 				snake = Snake{
 					pieces: [][]int32{
 						{
@@ -496,18 +884,40 @@ func main() {
 					started:   true,
 					gameOver:  false,
 					level:     snake.level,
+					mode:      snake.mode,
 				}
 				food = nil
 			} else {
+				if !snake.started {
+					// start on the seed typed in the menu
+					s, err := strconv.ParseInt(seedInput, 10, 64)
+					if err != nil {
+						s = seed
+					}
+					if s != seed || snake.mode != mapMode || snake.level != mapLevel {
+						loadMap(s, snake.mode, snake.level)
+						snake.pieces = [][]int32{
+							{
+								startingPos[1] + offsetX, // x pos
+								startingPos[0] + offsetY, // y pos
+							},
+						}
+					}
+					warmPool(snake.mode, snake.level)
+				}
 				snake.paused = !snake.paused
 				snake.started = true
 			}
 		}
 
 		if snake.gameOver && rl.IsKeyPressed(rl.KeySpace) {
+			useMap(nextMap(snake.mode, snake.level))
 			snake = Snake{
 				pieces: [][]int32{
-					{10, 6},
+					{
+						startingPos[1] + offsetX, // x pos
+						startingPos[0] + offsetY, // y pos
+					},
 				},
 				direction: Right,
 				score:     0,
@@ -515,6 +925,7 @@ func main() {
 				started:   false,
 				gameOver:  false,
 				level:     snake.level,
+				mode:      snake.mode,
 			}
 			food = nil
 		}
@@ -546,18 +957,57 @@ func main() {
 			}
 
 			snake.level = levels[current]
+
+			current = slices.Index(modes, snake.mode)
+			if rl.IsKeyPressed(rl.KeyUp) {
+				current = (current + len(modes) - 1) % len(modes)
+			}
+			if rl.IsKeyPressed(rl.KeyDown) {
+				current = (current + 1) % len(modes)
+			}
+			snake.mode = modes[current]
+
+			for c := rl.GetCharPressed(); c != 0; c = rl.GetCharPressed() {
+				if c >= '0' && c <= '9' && len(seedInput) < 9 {
+					seedInput += string(c)
+				}
+			}
+
+			if rl.IsKeyPressed(rl.KeyBackspace) && len(seedInput) > 0 {
+				seedInput = seedInput[:len(seedInput)-1]
+			}
+
+			if rl.IsKeyPressed(rl.KeyV) && snake.mode != ModeEndless {
+				s, err := strconv.ParseInt(seedInput, 10, 64)
+				if err != nil {
+					s = seed
+				}
+				visual = newVisualisation(planeWidth, planeHeight, s, snake.mode, snake.level)
+			}
 		}
 
 	}
 
 	addFood := func() {
+		// the map may change before the game starts
+		if !snake.started {
+			food = nil
+			return
+		}
+
 		generateNewFood := func() (int32, int32) {
 		Selector:
 			for {
 				x := randUInt32Between(foodRandXMin, foodRandXMax)
 				y := randUInt32Between(foodRandYMin, foodRandYMax)
+				if endless != nil {
+					// somewhere on screen
+					head := snake.pieces[0]
+					x = head[0] + rand.Int31n(planeWidth-2) - planeWidth/2 + 1
+					y = head[1] + rand.Int31n(planeHeight-2) - planeHeight/2 + 1
+				}
 
-				if wfcPlane[y-offsetY][x-offsetX][0] == 'S' {
+				if p := []int32{x, y}; !wfc.Passable(tileAt(p)) || solid(decorationAt(p)) {
 					continue Selector
 				}
 
@@ -656,6 +1106,50 @@ func main() {
 		size := rl.MeasureTextEx(font, text, fontSize, textSpacing)
 		position = rl.NewVector2(border.X+border.Width-size.X, border.Y+border.Height+20)
 		rl.DrawTextEx(font, text, position, fontSize, textSpacing, snakeColor)
+
+		text = fmt.Sprintf("SEED : %d", seed)
+		size = rl.MeasureTextEx(font, text, fontSize/2, textSpacing)
+		position = rl.NewVector2((width-size.X)/2, border.Y+border.Height+20+(fontSize-size.Y)/2)
+		rl.DrawTextEx(font, text, position, fontSize/2, textSpacing, snakeColor)
+	}
+
+	drawNotice := func() {
+		if notice == "" || rl.GetTime()-noticeTime > noticeDuration {
+			return
+		}
+		size := rl.MeasureTextEx(font, notice, fontSize/2, textSpacing)
+		position := rl.NewVector2((width-size.X)/2, (border.Y-borderThickness-size.Y)/2)
+		rl.DrawTextEx(font, notice, position, fontSize/2, textSpacing, snakeColor)
+	}
+
+	drawVisualisation := func() {
+		const optionsFontSize = 10
+		for y, row := range visual.options {
+			for x, n := range row {
+				if tile := visual.tiles[y][x]; tile != 0 {
+					drawTile(x, y, tile)
+					continue
+				}
+
+				text := strconv.Itoa(n)
+				size := rl.MeasureTextEx(font, text, optionsFontSize, textSpacing)
+				position := rl.NewVector2(
+					float32((x+offsetX)*step)+(step-size.X)/2,
+					float32((y+offsetY)*step)+(step-size.Y)/2,
+				)
+				rl.DrawTextEx(font, text, position, optionsFontSize, textSpacing, snakeColor)
+			}
+		}
+
+		text := fmt.Sprintf("ATTEMPT %d", visual.attempt+1)
+		if visual.done && visual.err != nil {
+			text = "NO VALID MAP FOR THIS SEED"
+		} else if visual.done {
+			text = "ENTER TO PLAY, V TO MENU"
+		}
+		size := rl.MeasureTextEx(font, text, fontSize, textSpacing)
+		position := rl.NewVector2((width-size.X)/2, border.Y+border.Height+20)
+		rl.DrawTextEx(font, text, position, fontSize, textSpacing, snakeColor)
 	}
 
 	drawCenteredText := func(text ...string) float32 {
@@ -672,7 +1166,7 @@ func main() {
 		return (height-fullTextHeight)/2 + float32((len(text)+1)*fontSize)
 	}
 
-	drawCenteredTextFromPosition := func(posY float32, options ...string) {
+	drawCenteredTextFromPosition := func(posY float32, selected string, options ...string) {
 		const y = width * 0.05
 
 		var K float32
@@ -695,7 +1189,7 @@ func main() {
 		for i, o := range options {
 			size := rl.MeasureTextEx(font, o, fontSize, textSpacing)
 			position := rl.NewVector2(prefix, posY)
-			if o == snake.level {
+			if o == selected {
 				padding(position, size)
 				rl.DrawTextEx(font, o, position, fontSize, textSpacing, bgColor)
 			} else {
@@ -717,29 +1211,107 @@ func main() {
 		rl.DrawTextEx(font, t, position, 100, textSpacing, snakeColor)
 	}
 
+	// the camera of the endless mode keeps the head in the middle of the
+	// board
+	camera := rl.Camera2D{
+		Offset: rl.NewVector2(border.X+border.Width/2, border.Y+border.Height/2),
+		Zoom:   1,
+	}
+
+	drawWorld := func() {
+		head := snake.pieces[0]
+		camera.Target = rl.NewVector2(float32(head[0]*step)+step/2, float32(head[1]*step)+step/2)
+
+		// the cells on screen, in plane coordinates
+		x0 := int(head[0]-offsetX) - planeWidth/2 - 1
+		y0 := int(head[1]-offsetY) - planeHeight/2 - 1
+		x1, y1 := x0+planeWidth+2, y0+planeHeight+2
+		endless.prefetch(x0-chunkSize, y0-chunkSize, x1+chunkSize, y1+chunkSize)
+
+		rl.BeginScissorMode(int32(border.X), int32(border.Y), int32(border.Width), int32(border.Height))
+		rl.BeginMode2D(camera)
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				cx, cy, i, j := chunkOf(x, y)
+				c := endless.chunks[[2]int{cx, cy}]
+				if c == nil {
+					continue
+				}
+				drawTile(x, y, c.terrain[j][i])
+				if c.decorations != nil {
+					drawDecoration(x, y, c.decorations[j][i])
+				}
+			}
+		}
+		drawSnake()
+		drawFood()
+		rl.EndMode2D()
+		rl.EndScissorMode()
+	}
+
+	// drawMetrics shows the metrics of the current map in the top left
+	// corner of the board
+	drawMetrics := func() {
+		if !showMetrics || mapMode == ModeEndless {
+			return
+		}
+		lines := []string{
+			fmt.Sprintf("LAND %.0f%%", mapMetrics.Land*100),
+			fmt.Sprintf("COAST %.0f%%", mapMetrics.Coast*100),
+			fmt.Sprintf("SEA %.0f%%", mapMetrics.Sea*100),
+			fmt.Sprintf("ROCK %.0f%%", mapMetrics.Rock*100),
+			fmt.Sprintf("ISLANDS %d", mapMetrics.Islands),
+			fmt.Sprintf("LARGEST %.0f%%", mapMetrics.Largest*100),
+			fmt.Sprintf("CORRIDOR %d", mapMetrics.Corridor),
+			fmt.Sprintf("DEAD ENDS %d", mapMetrics.DeadEnds),
+		}
+		lineHeight := float32(fontSize / 2)
+		rl.DrawRectangleV(rl.NewVector2(border.X, border.Y), rl.NewVector2(9*step, lineHeight*float32(len(lines))+step), rl.Fade(bgColor, 0.85))
+		for i, line := range lines {
+			position := rl.NewVector2(border.X+step/2, border.Y+step/2+lineHeight*float32(i))
+			rl.DrawTextEx(font, line, position, fontSize/2, textSpacing, snakeColor)
+		}
+	}
+
 	for !rl.WindowShouldClose() {
 		grabKeyPresses()
 		addFood()
 		if !snake.paused {
 			updateSnake()
 		}
+		updateTides()
 
 		rl.BeginDrawing()
 		rl.ClearBackground(bgColor)
 		drawGrid()
 		// draw
-		if snake.started && !snake.gameOver {
-			drawSnake()
-			drawFood()
+		if visual != nil {
+			visual.update(stepsPerFrame)
+			drawVisualisation()
+		} else if snake.started && !snake.gameOver {
+			if snake.mode == ModeEndless {
+				drawWorld()
+			} else {
+				drawSnake()
+				drawFood()
+			}
 			drawHud()
 		} else if snake.gameOver {
 			drawCenteredText("GAME OVER", "ENTER TO RESTART", "SPACE TO MENU")
 		} else {
 			drawGameTitle(".....SNAKE.....")
-			py := drawCenteredText("PRESS ENTER TO START")
-			drawCenteredTextFromPosition(py, levels...)
+			py := drawCenteredText("PRESS ENTER TO START", "V TO WATCH THE MAP GENERATE")
+			drawCenteredTextFromPosition(py, snake.level, levels...)
+			drawCenteredTextFromPosition(py+1.5*fontSize, snake.mode, modes...)
+
+			text := fmt.Sprintf("SEED : %s_", seedInput)
+			size := rl.MeasureTextEx(font, text, fontSize, textSpacing)
+			rl.DrawTextEx(font, text, rl.NewVector2((width-size.X)/2, py+3*fontSize), fontSize, textSpacing, snakeColor)
 		}
 
+		drawMetrics()
+		drawNotice()
+
 		rl.EndDrawing()
 	}
 
@@ -2,4 +2,4 @@ module snake
 
 go 1.22
 
-require github.com/gen2brain/raylib-go/raylib v0.0.0-20230928181314-dc2584151090 // indirect
+require github.com/gen2brain/raylib-go/raylib v0.0.0-20230928181314-dc2584151090
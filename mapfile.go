@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"snake/wfc"
+)
+
+// thumbnailScale is the side in pixels of a tile in map thumbnails
+const thumbnailScale = 4
+
+// savedMapsDir is where maps saved during the game go
+const savedMapsDir = "maps"
+
+var errEmptyMap = errors.New("map file has no terrain")
+
+// savedMap is a map as written to JSON files
+type savedMap struct {
+	Seed   int64 `json:"seed"`
+	Width  int   `json:"width"`
+	Height int   `json:"height"`
+	Mode   Mode  `json:"mode"`
+	Level  Level `json:"level"`
+	// Style and Sample are what the terrain was learned from, Sample is
+	// the file given on the command line if any, else the style's own
+	Style  string `json:"style"`
+	Sample string `json:"sample"`
+	// Spawn is where the snake starts, as {row, col}
+	Spawn       []int32  `json:"spawn"`
+	Terrain     []string `json:"terrain"`
+	Decorations []string `json:"decorations,omitempty"`
+}
+
+func newSavedMap(m generatedMap) savedMap {
+	s := savedMap{
+		Seed:    m.seed,
+		Width:   m.plane.Width(),
+		Height:  m.plane.Height(),
+		Mode:    m.mode,
+		Level:   m.level,
+		Style:   *mapStyleFlag,
+		Sample:  mapStyles[*mapStyleFlag].sample,
+		Spawn:   m.pos,
+		Terrain: planeRows(m.plane),
+	}
+	if t := terrains[m.level]; t != nil && t.profile.sample != "" {
+		s.Sample = t.profile.sample
+	}
+	if *sampleFlag != "" {
+		s.Sample = *sampleFlag
+	}
+	if m.decorations != nil {
+		s.Decorations = planeRows(m.decorations)
+	}
+	return s
+}
+
+func planeRows(p wfc.Plane) []string {
+	rows := make([]string, len(p))
+	for y, row := range p {
+		rows[y] = string(row)
+	}
+	return rows
+}
+
+func readRows(rows []string, read func(io.Reader) (wfc.Plane, error)) (wfc.Plane, error) {
+	return read(strings.NewReader(strings.Join(rows, "\n")))
+}
+
+// generatedMap checks the saved map and turns it back into one to play on.
+func (s savedMap) generatedMap() (generatedMap, error) {
+	m := generatedMap{seed: s.Seed, mode: s.Mode, level: s.Level, pos: s.Spawn}
+	if len(s.Terrain) == 0 {
+		return m, errEmptyMap
+	}
+
+	var err error
+	if m.plane, err = readRows(s.Terrain, wfc.ReadSample); err != nil {
+		return m, err
+	}
+	if s.Width != m.plane.Width() || s.Height != m.plane.Height() {
+		return m, fmt.Errorf("terrain is %dx%d, want %dx%d", m.plane.Width(), m.plane.Height(), s.Width, s.Height)
+	}
+	if s.Decorations != nil {
+		if m.decorations, err = readRows(s.Decorations, wfc.ReadDecorations); err != nil {
+			return m, err
+		}
+		if m.decorations.Width() != s.Width || m.decorations.Height() != s.Height {
+			return m, fmt.Errorf("decorations are %dx%d, want %dx%d", m.decorations.Width(), m.decorations.Height(), s.Width, s.Height)
+		}
+	}
+	if len(m.pos) != 2 || m.pos[0] < 0 || m.pos[1] < 0 || int(m.pos[0]) >= s.Height || int(m.pos[1]) >= s.Width {
+		return m, fmt.Errorf("spawn %v is off the map", m.pos)
+	}
+	if !wfc.Passable(m.plane[m.pos[0]][m.pos[1]]) || m.decorations != nil && solid(m.decorations[m.pos[0]][m.pos[1]]) {
+		return m, fmt.Errorf("spawn %v is not on dry land", m.pos)
+	}
+	if !slices.Contains(modes, m.mode) || m.mode == ModeEndless {
+		return m, fmt.Errorf("unknown mode %q", m.mode)
+	}
+	if !slices.Contains(levels, m.level) {
+		return m, fmt.Errorf("unknown level %q", m.level)
+	}
+
+	return m, nil
+}
+
+// useStyle makes the map style and sample those of the saved map, so that
+// tides and the maps after it are generated like it was. Samples given on
+// the command line must still be there.
+func (s savedMap) useStyle() error {
+	// maps written by hand may leave them out
+	if s.Style == "" {
+		return nil
+	}
+	style, ok := mapStyles[s.Style]
+	if !ok {
+		return fmt.Errorf("unknown map style %q", s.Style)
+	}
+
+	*mapStyleFlag, *sampleFlag = s.Style, ""
+	if s.Sample == style.sample || s.Sample == style.levels[s.Level].sample {
+		return nil
+	}
+	if _, err := os.Stat(s.Sample); err != nil {
+		return fmt.Errorf("map was learned from %s: %w", s.Sample, err)
+	}
+	*sampleFlag = s.Sample
+	return nil
+}
+
+// saveMap writes m to path, as JSON for .json files, as a thumbnail for
+// .png files and as ASCII otherwise.
+func saveMap(path string, m generatedMap) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(newSavedMap(m))
+	case ".png":
+		err = png.Encode(f, wfc.EncodeImage(m.plane, wfc.DefaultPalette, thumbnailScale))
+	default:
+		err = writeASCIIMap(f, m)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeASCIIMap writes the compact form of a map: the terrain in the
+// sample format, preceded by comments holding the rest and followed by
+// the decorations. Maps without decorations are samples in their own
+// right.
+func writeASCIIMap(out io.Writer, m generatedMap) error {
+	s := newSavedMap(m)
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "# seed %d\n", s.Seed)
+	fmt.Fprintf(w, "# mode %s\n", s.Mode)
+	fmt.Fprintf(w, "# level %s\n", s.Level)
+	fmt.Fprintf(w, "# style %s\n", s.Style)
+	fmt.Fprintf(w, "# sample %s\n", s.Sample)
+	fmt.Fprintf(w, "# spawn %d %d\n", s.Spawn[0], s.Spawn[1])
+	if err := wfc.WritePlane(w, m.plane); err != nil {
+		return err
+	}
+	if m.decorations != nil {
+		fmt.Fprintln(w, "# decorations")
+		if err := wfc.WritePlane(w, m.decorations); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// readMapFile reads a map written by saveMap as JSON or ASCII.
+func readMapFile(path string) (savedMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return savedMap{}, err
+	}
+
+	// maps saved before levels had terrain of their own are SLUG maps
+	s := savedMap{Level: Level1}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return s, fmt.Errorf("%s: %w", path, err)
+		}
+	} else {
+		s = parseASCIIMap(string(data))
+	}
+	return s, nil
+}
+
+// parseASCIIMap reads the comments and rows written by writeASCIIMap,
+// leaving anything it doesn't know about for generatedMap to reject.
+func parseASCIIMap(text string) savedMap {
+	s := savedMap{Mode: ModeClassic, Level: Level1}
+	rows := &s.Terrain
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			*rows = append(*rows, line)
+			continue
+		}
+
+		key, value, _ := strings.Cut(strings.TrimSpace(line[1:]), " ")
+		switch key {
+		case "seed":
+			s.Seed, _ = strconv.ParseInt(value, 10, 64)
+		case "mode":
+			s.Mode = value
+		case "level":
+			s.Level = value
+		case "style":
+			s.Style = value
+		case "sample":
+			s.Sample = value
+		case "spawn":
+			var row, col int32
+			if _, err := fmt.Sscanf(value, "%d %d", &row, &col); err == nil {
+				s.Spawn = []int32{row, col}
+			}
+		case "decorations":
+			rows = &s.Decorations
+		}
+	}
+	if len(s.Terrain) > 0 {
+		s.Width, s.Height = len(s.Terrain[0]), len(s.Terrain)
+	}
+	return s
+}
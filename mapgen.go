@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"snake/wfc"
+)
+
+// genStats counts what the generator went through for a map, it is
+// updated from the generator's workers
+type genStats struct {
+	attempts       atomic.Int64
+	contradictions atomic.Int64
+	rejected       atomic.Int64
+}
+
+// observe counts the attempts and contradictions of opts and the planes
+// its validators reject.
+func (s *genStats) observe(opts *wfc.Options) {
+	opts.Observer = func(st wfc.Step) {
+		switch st.Kind {
+		case wfc.StepStart:
+			s.attempts.Add(1)
+		case wfc.StepContradiction:
+			s.contradictions.Add(1)
+		}
+	}
+
+	validators := opts.Validators
+	opts.Validators = []wfc.Validator{func(p wfc.Plane) error {
+		err := wfc.Validate(p, validators...)
+		if errors.Is(err, wfc.ErrRejected) {
+			s.rejected.Add(1)
+		}
+		return err
+	}}
+}
+
+// mapgen is the mapgen subcommand: it generates maps without a window and
+// prints them or writes them to files, reporting how generation went on
+// stderr. It returns the exit status.
+func mapgen(args []string) int {
+	fs := flag.NewFlagSet("mapgen", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: snake mapgen [flags]")
+		fmt.Fprintln(fs.Output(), "generates maps as the game does and prints them as ASCII, or writes them to -o")
+		fs.PrintDefaults()
+	}
+	w := fs.Int("width", planeWidth, "map width in tiles")
+	h := fs.Int("height", planeHeight, "map height in tiles")
+	seed := fs.Int64("seed", 0, "seed of the first map, a random one is picked when 0")
+	count := fs.Int("count", 1, "how many maps to generate, with seeds following the first")
+	mode := fs.String("mode", ModeClassic, "game mode to generate for: CLASSIC, WRAP or TIDES")
+	level := fs.String("level", Level1, "level whose terrain profile to use: SLUG, WORM or PYTHON")
+	fs.StringVar(mapStyleFlag, "style", "simple", "terrain style: simple, islands or wilds")
+	fs.StringVar(sampleFlag, "sample", "", "sample `file` to learn the terrain from instead of the style's own")
+	minReachable := fs.Float64("min-reachable", -1, "share of the map that must be reachable from the spawn, the style's own when negative")
+	fs.BoolVar(solidFlag, "solid", false, "trees, boulders and huts block the snake")
+	acceptanceFlags(fs)
+	timeout := fs.Duration("timeout", generationTimeout, "time allowed for every map")
+	out := fs.String("o", "", "`file` to write to, as JSON, PNG or ASCII by extension; the seed is added to the name when -count is above 1")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	*mode = strings.ToUpper(*mode)
+	if !slices.Contains(modes, *mode) || *mode == ModeEndless {
+		fmt.Fprintf(os.Stderr, "mapgen: unknown mode %q\n", *mode)
+		return 2
+	}
+	*level = strings.ToUpper(*level)
+	if !slices.Contains(levels, *level) {
+		fmt.Fprintf(os.Stderr, "mapgen: unknown level %q\n", *level)
+		return 2
+	}
+	if *w < spawnSize || *h < spawnSize || *count < 1 {
+		fmt.Fprintf(os.Stderr, "mapgen: maps must be at least %dx%d and count at least 1\n", spawnSize, spawnSize)
+		return 2
+	}
+	if err := learnStyle(); err != nil {
+		fmt.Fprintln(os.Stderr, "mapgen:", err)
+		return 1
+	}
+	if *minReachable >= 0 {
+		style := mapStyles[*mapStyleFlag]
+		style.minReachable = *minReachable
+		mapStyles[*mapStyleFlag] = style
+	}
+	if *seed == 0 {
+		*seed = newSeed()
+	}
+
+	status := 0
+	start := time.Now()
+	for i := 0; i < *count; i++ {
+		s := *seed + int64(i)
+		opts, pos := mapOptions(*w, *h, s, *mode, *level)
+		var stats genStats
+		stats.observe(&opts)
+
+		t := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		plane, decorations, err := generateMap(ctx, terrains[*level], *w, *h, opts, pos)
+		cancel()
+		elapsed := time.Since(t)
+
+		fmt.Fprintf(os.Stderr, "seed %d: %dx%d %s %s in %v, %d attempts, %d contradictions, %d rejected",
+			s, *w, *h, *mode, *level, elapsed.Round(time.Millisecond), stats.attempts.Load(), stats.contradictions.Load(), stats.rejected.Load())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, ": %v\n", err)
+			status = 1
+			continue
+		}
+		open := plane
+		if decorations != nil {
+			open = obstruct(plane, decorations)
+		}
+		reachable := wfc.Reachable(open, int(pos[1]), int(pos[0]))
+		if *mode == ModeWrap {
+			reachable = wfc.ReachableWrapped(open, int(pos[1]), int(pos[0]))
+		}
+		fmt.Fprintf(os.Stderr, ", %.0f%% reachable\n", float64(reachable)*100/float64(*w**h))
+		fmt.Fprintf(os.Stderr, "  %v\n", measureMap(plane, decorations, *mode))
+
+		m := generatedMap{seed: s, mode: *mode, level: *level, plane: plane, decorations: decorations, pos: pos}
+		if err := writeGenerated(*out, *count > 1, m); err != nil {
+			fmt.Fprintln(os.Stderr, "mapgen:", err)
+			return 1
+		}
+	}
+	if *count > 1 {
+		fmt.Fprintf(os.Stderr, "%d maps in %v on %d CPUs\n", *count, time.Since(start).Round(time.Millisecond), runtime.NumCPU())
+	}
+
+	return status
+}
+
+// writeGenerated writes m to path, or to stdout as ASCII when path is
+// empty. With numbered set the seed goes in the name of the file.
+func writeGenerated(path string, numbered bool, m generatedMap) error {
+	if path == "" {
+		if numbered {
+			fmt.Println()
+		}
+		return writeASCIIMap(os.Stdout, m)
+	}
+
+	if numbered {
+		ext := filepath.Ext(path)
+		path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), m.seed, ext)
+	}
+	return saveMap(path, m)
+}
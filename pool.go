@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+
+	"snake/wfc"
+)
+
+// poolSize is how many maps are kept ready ahead of time
+const poolSize = 2
+
+// generatedMap is a map ready to be played on, err is set when generation
+// failed for its seed
+type generatedMap struct {
+	seed  int64
+	mode  Mode
+	level Level
+	plane wfc.Plane
+	// decorations lie over plane, nil when the map has none
+	decorations wfc.Plane
+	pos         []int32
+	err         error
+}
+
+// mapPool generates maps for random seeds in the background, so starting
+// a new game doesn't have to wait for the generator
+type mapPool struct {
+	maps   chan generatedMap
+	cancel context.CancelFunc
+}
+
+func newMapPool(w, h int, mode Mode, level Level) *mapPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &mapPool{
+		maps:   make(chan generatedMap, poolSize),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(p.maps)
+		for ctx.Err() == nil {
+			m := generatedMap{seed: newSeed(), mode: mode, level: level}
+			m.plane, m.decorations, m.pos, m.err = wfcInit(ctx, w, h, m.seed, mode, level)
+			select {
+			case p.maps <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// next returns the next pre-generated map, waiting for it if the pool is
+// empty
+func (p *mapPool) next() generatedMap {
+	return <-p.maps
+}
+
+func (p *mapPool) close() {
+	p.cancel()
+}
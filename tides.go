@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"snake/wfc"
+)
+
+// tides reshape a tideWidth by tideHeight part of the map around the
+// coast every tideInterval seconds, giving up on a tide after tideTimeout
+const tideInterval = 6
+const tideWidth = 12
+const tideHeight = 8
+const tideTimeout = 100 * time.Millisecond
+
+// tide regenerates the terrain and decorations of a region around a
+// coast cell of terrain picked with rng, learned as t. The cells in keep,
+// as {x, y} on the plane, stay passable and at least minReachable of the
+// map stays reachable from the first of them, solid decorations included.
+func tide(rng *rand.Rand, t *levelTerrain, terrain, decorations wfc.Plane, keep [][]int32, minReachable float64) (wfc.Plane, wfc.Plane, error) {
+	var coast [][2]int
+	for y, row := range terrain {
+		for x, tile := range row {
+			if tile == wfc.Coast {
+				coast = append(coast, [2]int{x, y})
+			}
+		}
+	}
+	cx, cy := rng.Intn(terrain.Width()), rng.Intn(terrain.Height())
+	if len(coast) != 0 {
+		c := coast[rng.Intn(len(coast))]
+		cx, cy = c[0], c[1]
+	}
+	x := min(max(cx-tideWidth/2, 0), terrain.Width()-tideWidth)
+	y := min(max(cy-tideHeight/2, 0), terrain.Height()-tideHeight)
+
+	var passable, harmless []wfc.Tile
+	for _, tile := range t.model.Tiles() {
+		if wfc.Passable(tile) {
+			passable = append(passable, tile)
+		}
+	}
+	var keepTerrain, keepDecorations []wfc.Constraint
+	for _, p := range keep {
+		keepTerrain = append(keepTerrain, wfc.Pin(int(p[0]), int(p[1]), passable...))
+	}
+
+	reachable := wfc.MinReachable(int(keep[0][0]), int(keep[0][1]), minReachable)
+	ctx, cancel := context.WithTimeout(context.Background(), tideTimeout)
+	defer cancel()
+	terrain, err := wfc.Regenerate(ctx, terrain, x, y, tideWidth, tideHeight, wfc.Options{
+		Model:       t.model,
+		Seed:        rng.Int63(),
+		Constraints: keepTerrain,
+		Validators:  []wfc.Validator{reachable},
+	})
+	if err != nil || decorations == nil || t.decorations == nil {
+		return terrain, decorations, err
+	}
+
+	for _, tile := range t.decorations.Model.Tiles() {
+		if !solid(tile) {
+			harmless = append(harmless, tile)
+		}
+	}
+	for _, p := range keep {
+		keepDecorations = append(keepDecorations, wfc.Pin(int(p[0]), int(p[1]), harmless...))
+	}
+	decorations, err = wfc.Regenerate(ctx, decorations, x, y, tideWidth, tideHeight, wfc.Options{
+		Model:       t.decorations.Model,
+		Seed:        rng.Int63(),
+		Constraints: append(t.decorations.Constraints(terrain), keepDecorations...),
+		Validators: []wfc.Validator{func(decorations wfc.Plane) error {
+			return reachable(obstruct(terrain, decorations))
+		}},
+	})
+	return terrain, decorations, err
+}
+
+// tideResult is a tide generated in the background, from is the terrain
+// it was generated from
+type tideResult struct {
+	from, terrain, decorations wfc.Plane
+	err                        error
+}
+
+// startTide generates a tide in the background, see tide, and sends it
+// on the returned channel once it is ready. rng is the tides' own and is
+// not to be used until then.
+func startTide(rng *rand.Rand, t *levelTerrain, terrain, decorations wfc.Plane, keep [][]int32, minReachable float64) <-chan tideResult {
+	done := make(chan tideResult, 1)
+	go func() {
+		r := tideResult{from: terrain}
+		r.terrain, r.decorations, r.err = tide(rng, t, terrain, decorations, keep, minReachable)
+		done <- r
+	}()
+	return done
+}
+
+// dry reports whether the cells in keep, as {x, y} on the plane, are
+// passable on terrain and free of solid decorations.
+func dry(terrain, decorations wfc.Plane, keep [][]int32) bool {
+	for _, p := range keep {
+		x, y := int(p[0]), int(p[1])
+		if x < 0 || y < 0 || x >= terrain.Width() || y >= terrain.Height() {
+			continue
+		}
+		if !wfc.Passable(terrain[y][x]) || decorations != nil && solid(decorations[y][x]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+
+	"snake/wfc"
+)
+
+// stepsPerFrame is how many generator steps the visualisation applies
+// every frame
+const stepsPerFrame = 40
+
+// visualisation replays the generation of a map step by step, as it is
+// shown from the menu
+type visualisation struct {
+	steps  chan wfc.Step
+	cancel context.CancelFunc
+	// options holds how many patterns every cell has left, tiles the tile
+	// of the cells that are collapsed
+	options [][]int
+	tiles   wfc.Plane
+	attempt int
+	done    bool
+	err     error
+}
+
+// newVisualisation starts generating the map of seed in the background,
+// pacing the generator to the steps the visualisation has consumed
+func newVisualisation(w, h int, seed int64, mode Mode, level Level) *visualisation {
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &visualisation{
+		steps:   make(chan wfc.Step, stepsPerFrame),
+		cancel:  cancel,
+		options: make([][]int, h),
+		tiles:   make(wfc.Plane, h),
+	}
+	for y := range v.options {
+		v.options[y] = make([]int, w)
+		v.tiles[y] = make([]wfc.Tile, w)
+	}
+
+	opts, _ := mapOptions(w, h, seed, mode, level)
+	// one attempt at a time keeps the steps of different attempts apart
+	opts.Workers = 1
+	opts.Observer = func(st wfc.Step) {
+		select {
+		case v.steps <- st:
+		case <-ctx.Done():
+		}
+	}
+
+	// err is only read once steps is closed
+	go func() {
+		defer close(v.steps)
+		_, v.err = wfc.GenerateContext(ctx, w, h, opts)
+	}()
+
+	return v
+}
+
+// update applies up to n pending steps without waiting for more
+func (v *visualisation) update(n int) {
+	for i := 0; i < n && !v.done; i++ {
+		select {
+		case st, ok := <-v.steps:
+			if !ok {
+				v.done = true
+				return
+			}
+			v.apply(st)
+		default:
+			return
+		}
+	}
+}
+
+func (v *visualisation) apply(st wfc.Step) {
+	if st.Kind == wfc.StepStart {
+		v.attempt = st.Attempt
+		for y := range v.options {
+			for x := range v.options[y] {
+				v.options[y][x] = st.Options
+				v.tiles[y][x] = 0
+			}
+		}
+		return
+	}
+
+	v.options[st.Y][st.X] = st.Options
+	v.tiles[st.Y][st.X] = st.Tile
+}
+
+func (v *visualisation) close() {
+	v.cancel()
+}
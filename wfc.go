@@ -1,243 +1,363 @@
 package main
 
 import (
+	"context"
+	"embed"
+	"flag"
 	"fmt"
-	"math"
+	"io"
 	"math/rand"
+	"runtime"
 	"slices"
+	"time"
+
+	"snake/wfc"
 )
 
-var inputMatrix = [][]uint8{
-	{'L', 'L', 'L', 'L', 'L'},
-	{'L', 'L', 'L', 'L', 'L'},
-	{'L', 'C', 'C', 'C', 'L'},
-	{'C', 'S', 'S', 'S', 'C'},
-	{'S', 'S', 'S', 'S', 'S'},
-	{'S', 'S', 'S', 'S', 'S'},
-	{'S', 'S', 'S', 'S', 'S'},
+//go:embed assets/samples
+var samples embed.FS
+
+type mapStyle struct {
+	// sample is the name of the embedded sample in assets/samples
+	sample string
+	model  wfc.ModelOptions
+	// decorations is the name of the embedded sample of the decorations
+	// laid over sample, if the style has any
+	decorations string
+	// minReachable is the share of the map the snake must be able to
+	// reach from where it spawns
+	minReachable float64
+	// levels makes the maps of the easier levels roomier and those of the
+	// harder ones tighter
+	levels map[Level]terrainProfile
 }
 
-type v2 struct {
-	x, y int
+// terrainProfile is how the maps of a level differ from the style's own
+type terrainProfile struct {
+	// sample, model and decorations replace those of the style when
+	// sample is set, the level has no decorations if decorations isn't
+	sample      string
+	model       *wfc.ModelOptions
+	decorations string
+	// weights scales how often tiles are picked, see wfc.Model.Reweight
+	weights map[wfc.Tile]float64
+	// minLand is the least share of the map covered by land and corridor
+	// the width its narrowest passage may not go below, see wfc.Metrics
+	minLand  float64
+	corridor int
 }
 
-func validDirections(mh, mw, x, y int) []v2 {
-	var ds []v2
+var mapStyles = map[string]mapStyle{
+	// land on one side of the sea, learned both ways up, with the corners
+	// of tiles checked as well as their sides
+	"simple": {
+		sample:       "simple.txt",
+		model:        wfc.ModelOptions{Symmetry: wfc.Reverse, Diagonal: true},
+		minReachable: 0.5,
+		// the land floods the map from the spawn patch, so the harder
+		// levels are cut into fields by channels grown with the
+		// overlapping model
+		levels: map[Level]terrainProfile{
+			Level2: {sample: "channels.txt", model: &channelsModel, corridor: 3},
+			Level3: {sample: "channels.txt", model: &channelsModel, corridor: 2},
+		},
+	},
+	// a lake with an island in it, the overlapping model grows coherent
+	// coastlines, bays and peninsulas out of it
+	"islands": {
+		sample:       "islands.txt",
+		model:        wfc.ModelOptions{N: 3, Symmetry: wfc.Mirror | wfc.Rotate},
+		decorations:  "islands.decor.txt",
+		minReachable: 0.3,
+		levels: map[Level]terrainProfile{
+			Level1: {weights: map[wfc.Tile]float64{wfc.Land: 1.5}, minLand: 0.6, corridor: 3},
+			Level2: {minLand: 0.5, corridor: 2},
+			// narrow causeways between lagoons instead of a lake
+			Level3: {sample: "lagoons.txt", decorations: "lagoons.decor.txt"},
+		},
+	},
+	// woods, rocks and dunes crossed by rivers that can only be crossed
+	// at their bridges
+	"wilds": {
+		sample:       "wilds.txt",
+		model:        wfc.ModelOptions{N: 3, Symmetry: wfc.Mirror},
+		decorations:  "wilds.decor.txt",
+		minReachable: 0.4,
+		levels: map[Level]terrainProfile{
+			// bridges are one tile wide, corridors can't be asked for
+			Level1: {weights: map[wfc.Tile]float64{wfc.Rock: 0.5, wfc.River: 0.5}},
+			Level3: {weights: map[wfc.Tile]float64{wfc.Rock: 2, wfc.River: 2}},
+		},
+	},
+}
 
-	// up
-	if y-1 >= 0 {
-		ds = append(ds, v2{0, -1})
-	}
-	// down
-	if y+1 < mh {
-		ds = append(ds, v2{0, 1})
-	}
-	// left
-	if x-1 >= 0 {
-		ds = append(ds, v2{-1, 0})
-	}
-	// right
-	if x+1 < mw {
-		ds = append(ds, v2{1, 0})
-	}
+// channelsModel learns the channels of the simple style
+var channelsModel = wfc.ModelOptions{N: 3, Symmetry: wfc.Mirror | wfc.Rotate}
+
+var mapStyleFlag = flag.String("style", "simple", "terrain style: simple, islands or wilds")
+var sampleFlag = flag.String("sample", "", "sample `file` to learn the terrain from instead of the style's own (ASCII using the L/C/S/F/R/D/W/B legend, or PNG)")
 
-	return ds
+var seedFlag = flag.Int64("seed", 0, "seed of the first map, a random one is picked when 0")
+var mapFlag = flag.String("map", "", "saved map `file` to play on first, JSON or ASCII as written by F2")
+var solidFlag = flag.Bool("solid", false, "trees, boulders and huts block the snake")
+
+// acceptance holds the limits set on the command line for the metrics of
+// generated maps
+var acceptance = wfc.NoThresholds
+
+// acceptanceFlags adds the flags setting acceptance to fs.
+func acceptanceFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&acceptance.MinLand, "min-land", -1, "least share of the map covered by land, woods, dunes and bridges, not checked when negative")
+	fs.Float64Var(&acceptance.MaxSea, "max-sea", -1, "greatest share of the map covered by sea and rivers, not checked when negative")
+	fs.IntVar(&acceptance.MaxIslands, "max-islands", -1, "most separate areas the snake can move in, not checked when negative")
+	fs.Float64Var(&acceptance.MinLargest, "min-largest", -1, "least share of the map covered by the largest area the snake can move in, not checked when negative")
+	fs.IntVar(&acceptance.MinCorridor, "min-corridor", -1, "width of the narrowest passage allowed in the largest area, not checked when negative")
+	fs.IntVar(&acceptance.MaxDeadEnds, "max-dead-ends", -1, "most cells the snake can only leave the way it came, not checked when negative")
 }
 
-func generateRules(matrix [][]uint8) (map[string]bool, map[uint8]uint) {
-	rules := make(map[string]bool)
-	weights := make(map[uint8]uint)
-	for y, row := range matrix {
-		for x, tile := range row {
-			if _, ok := weights[tile]; !ok {
-				weights[tile] = 0
-			}
-			weights[tile] += 1
-			directions := validDirections(len(matrix), len(matrix[0]), x, y)
-			for _, d := range directions {
-				a := matrix[y+d.y][x+d.x]
-				k := fmt.Sprintf("%c%c%d%d", tile, a, d.x, d.y)
-				rules[k] = true
-			}
-		}
-	}
+func init() {
+	acceptanceFlags(flag.CommandLine)
+}
 
-	return rules, weights
+// levelTerrain is what the maps of a level are generated from
+type levelTerrain struct {
+	sample wfc.Plane
+	model  *wfc.Model
+	// decorations places decorations over the terrain, nil when there are
+	// none or the terrain is learned from a sample of the command line
+	decorations *wfc.Layer
+	profile     terrainProfile
 }
 
-func getLowestEntropyCoords(weights map[uint8]uint, plane [][][]uint8) v2 {
-	shannonEntropy := func(options []uint8) float64 {
-		sm := 0.0
-		smLog := 0.0
-		for _, o := range options {
-			ww := float64(weights[o])
-			sm += ww
-			smLog += ww * math.Log(ww)
-		}
-		return math.Log(sm) - (smLog / sm)
-	}
-	min := math.Inf(1)
-	var coords = v2{}
-	for y, row := range plane {
-		for x, options := range row {
-			if len(options) == 1 {
-				continue
-			}
+// terrains holds the terrain of every level in the current map style
+var terrains map[Level]*levelTerrain
 
-			e := shannonEntropy(options)
-			e = e - (rand.Float64() / 1000)
-			if e < min {
-				min = e
-				coords = v2{x, y}
-			}
-		}
-	}
+// solidDecorations kill the snake when the solid flag is set
+var solidDecorations = map[wfc.Tile]bool{
+	wfc.Tree:    true,
+	wfc.Boulder: true,
+	wfc.Hut:     true,
+}
+
+func solid(decoration wfc.Tile) bool {
+	return *solidFlag && solidDecorations[decoration]
+}
 
-	return coords
+// newSeed picks a random map seed short enough to be typed in the menu.
+func newSeed() int64 {
+	return 1 + rand.Int63n(999_999_999)
 }
 
-func collapse(coords v2, weights map[uint8]uint, plane [][][]uint8) {
-	opts := plane[coords.y][coords.x]
+// levelSeed returns the seed the maps of level are generated from for
+// seed, so the same seed gives each level its own map. The first level
+// keeps seed as it is.
+func levelSeed(seed int64, level Level) int64 {
+	return seed ^ int64(slices.Index(levels, level))*2654435761
+}
 
-	totalWeight := 0.0
-	for _, o := range opts {
-		totalWeight += float64(weights[o])
+// loadSample reads the sample given on the command line, or the embedded
+// one of that name.
+func loadSample(name string) (wfc.Plane, error) {
+	if *sampleFlag != "" {
+		return wfc.LoadSample(*sampleFlag)
 	}
 
-	totalWeight = totalWeight * rand.Float64()
+	return readEmbeddedSample(name, wfc.ReadSample)
+}
 
-	pick := opts[0]
+// readEmbeddedSample reads the embedded sample name with read.
+func readEmbeddedSample(name string, read func(io.Reader) (wfc.Plane, error)) (wfc.Plane, error) {
+	f, err := samples.Open("assets/samples/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return read(f)
+}
 
-	for _, o := range opts {
-		totalWeight -= float64(weights[o])
-		if totalWeight < 0 {
-			pick = o
-			break
-		}
+// learnStyle learns the terrain and decorations of every level in the
+// current map style.
+func learnStyle() error {
+	style, ok := mapStyles[*mapStyleFlag]
+	if !ok {
+		return fmt.Errorf("unknown map style %q", *mapStyleFlag)
 	}
-	//pick := opts[rand.Intn(len(opts))]
-	plane[coords.y][coords.x] = []uint8{pick}
-}
-
-func propagate(coords v2, rules map[string]bool, plane [][][]uint8) {
-	stack := []v2{coords}
-
-	for len(stack) != 0 {
-		curCoords := stack[len(stack)-1]
-		stack = stack[0 : len(stack)-1]
-
-		tiles := plane[curCoords.y][curCoords.x]
-		ds := validDirections(len(plane), len(plane[0]), curCoords.x, curCoords.y)
-
-		for _, d := range ds {
-			options := plane[curCoords.y+d.y][curCoords.x+d.x]
-			var keep []uint8
-			for _, otherTile := range options {
-				var ok bool
-				for _, tile := range tiles {
-					k := fmt.Sprintf("%c%c%d%d", tile, otherTile, d.x, d.y)
-					if _, ok = rules[k]; ok {
-						break
-					}
-				}
-
-				if ok {
-					keep = append(keep, otherTile)
-				} else {
-					stack = append(stack, v2{curCoords.x + d.x, curCoords.y + d.y})
-				}
+
+	// levels sharing a sample share what is learned from it
+	learned := make(map[string]*levelTerrain)
+	terrains = make(map[Level]*levelTerrain)
+	for _, level := range levels {
+		profile := style.levels[level]
+		name, model, decorations := style.sample, style.model, style.decorations
+		if profile.sample != "" {
+			name, decorations = profile.sample, profile.decorations
+			if profile.model != nil {
+				model = *profile.model
+			}
+		}
+
+		t, ok := learned[name]
+		if !ok {
+			t = &levelTerrain{}
+			var err error
+			if t.sample, err = loadSample(name); err != nil {
+				return err
+			}
+			if t.model, err = wfc.NewModel(t.sample, model); err != nil {
+				return err
 			}
-			if keep != nil {
-				plane[curCoords.y+d.y][curCoords.x+d.x] = keep
+			if t.decorations, err = loadDecorations(decorations, t.sample); err != nil {
+				return err
 			}
+			learned[name] = t
+		}
+
+		lt := *t
+		lt.profile = profile
+		if profile.weights != nil {
+			lt.model = t.model.Reweight(profile.weights)
 		}
+		terrains[level] = &lt
 	}
+	return nil
 }
 
-func fullyCollapsed(plane [][][]uint8) bool {
-	for _, row := range plane {
-		for _, opts := range row {
-			if len(opts) != 1 {
-				return false
-			}
-		}
+// loadDecorations learns the decorations of the embedded sample name laid
+// over terrain, if there are any.
+func loadDecorations(name string, terrain wfc.Plane) (*wfc.Layer, error) {
+	if name == "" || *sampleFlag != "" {
+		return nil, nil
 	}
 
-	return true
+	sample, err := readEmbeddedSample(name, wfc.ReadDecorations)
+	if err != nil {
+		return nil, err
+	}
+	return wfc.NewLayer(sample, terrain, wfc.ModelOptions{})
 }
 
-func wfc(weights map[uint8]uint, rules map[string]bool, w, h int) [][][]uint8 {
-	// init plane - start
-	var plane [][][]uint8 = make([][][]uint8, h)
+// spawnSize is the side of the land patch the snake starts in the middle of
+const spawnSize = 5
 
-	for yy := 0; yy < h; yy++ {
-		plane[yy] = make([][]uint8, w)
-		for xx := 0; xx < w; xx++ {
-			plane[yy][xx] = []uint8{'L', 'C', 'S'}
-		}
-	}
-	// init plane - end
+// generation gives up on a seed after this many maps or this much time
+const maxAttempts = 100
+const generationTimeout = 3 * time.Second
 
-	for !fullyCollapsed(plane) {
-		c := getLowestEntropyCoords(weights, plane)
-		collapse(c, weights, plane)
-		propagate(c, rules, plane)
-	}
+//go:embed assets/maps/fallback.txt
+var fallbackMapData []byte
 
-	return plane
+// fallbackMap returns the known-good map used when generation fails, a
+// map written by mapgen.
+func fallbackMap() (wfc.Plane, wfc.Plane, []int32) {
+	m, err := parseASCIIMap(string(fallbackMapData)).generatedMap()
+	if err != nil {
+		panic(err)
+	}
+	return m.plane, m.decorations, m.pos
 }
 
-func planeHasLandPath(w, h int, plane [][][]uint8) bool {
-	for col := 0; col < w; col++ {
-		isAllSea := true
-		for row := 0; row < h; row++ {
-			tile := plane[row][col][0]
-			if tile != 'S' {
-				isAllSea = false
-			}
-		}
+// mapOptions returns the generator options for the map of seed in a game
+// mode and level and where the snake spawns on it, as {row, col}.
+func mapOptions(w, h int, seed int64, mode Mode, level Level) (wfc.Options, []int32) {
+	t := terrains[level]
+	rng := rand.New(rand.NewSource(levelSeed(seed, level)))
 
-		if isAllSea {
-			return false
-		}
+	// top left corner of the spawn patch, pinned to land up front
+	x := rng.Intn(w - spawnSize + 1)
+	y := rng.Intn(h - spawnSize + 1)
+	pos := []int32{
+		int32(y + spawnSize/2),
+		int32(x + spawnSize/2),
+	}
+
+	opts := wfc.Options{
+		Model:       t.model,
+		Seed:        rng.Int63(),
+		Constraints: []wfc.Constraint{wfc.Rect(x, y, spawnSize, spawnSize, wfc.Land)},
+		Attempts:    maxAttempts,
+		Workers:     runtime.NumCPU(),
 	}
-	return true
+
+	minReachable := mapStyles[*mapStyleFlag].minReachable
+	if mode == ModeWrap {
+		opts.Periodic = true
+		opts.Validators = append(opts.Validators, wfc.MinReachableWrapped(int(pos[1]), int(pos[0]), minReachable))
+	} else {
+		opts.Validators = append(opts.Validators, wfc.MinReachable(int(pos[1]), int(pos[0]), minReachable))
+	}
+	// the level may ask for more than the command line
+	accept := acceptance
+	if t.profile.minLand > 0 {
+		accept.MinLand = max(accept.MinLand, t.profile.minLand)
+	}
+	if t.profile.corridor > 0 {
+		accept.MinCorridor = max(accept.MinCorridor, t.profile.corridor)
+	}
+	if accept != wfc.NoThresholds {
+		opts.Validators = append(opts.Validators, wfc.Accept(accept, mode == ModeWrap))
+	}
+	return opts, pos
 }
 
-func findSuitableStartingPosition(w, h int, plane [][][]uint8) []int32 {
-	// find a 5x5 patch of land
-	validPatch := func(y, x int) bool {
-		for row := y; row < y+5; row++ {
-			for col := x; col < x+5; col++ {
-				if plane[row][col][0] != 'L' {
-					return false
-				}
-			}
-		}
-		return true
-	}
-	for row := 0; row < h-5; row++ {
-		for col := 0; col < w-5; col++ {
-			if validPatch(row, col) {
-				return []int32{
-					int32(row + 2),
-					int32(col + 2),
-				}
+// obstruct returns terrain with the cells under solid decorations turned
+// to rock, as far as the snake is concerned they are the same.
+func obstruct(terrain, decorations wfc.Plane) wfc.Plane {
+	out := make(wfc.Plane, len(terrain))
+	for y, row := range terrain {
+		out[y] = append([]wfc.Tile(nil), row...)
+		for x := range row {
+			if solid(decorations[y][x]) {
+				out[y][x] = wfc.Rock
 			}
 		}
 	}
-	return []int32{-1, -1}
+	return out
 }
 
-func wfcInit(w, h int) ([][][]uint8, []int32) {
-	if rand.Float32() >= 0.5 {
-		slices.Reverse(inputMatrix)
+// wfcInit generates the map for seed and the decorations over it, nil
+// when the level has none. The same seed, mode and level always produce
+// the same map.
+func wfcInit(ctx context.Context, w, h int, seed int64, mode Mode, level Level) (wfc.Plane, wfc.Plane, []int32, error) {
+	opts, pos := mapOptions(w, h, seed, mode, level)
+
+	ctx, cancel := context.WithTimeout(ctx, generationTimeout)
+	defer cancel()
+	plane, decorations, err := generateMap(ctx, terrains[level], w, h, opts, pos)
+	return plane, decorations, pos, err
+}
+
+// generateMap generates a map of terrain t and its decorations with the
+// options mapOptions returned for it, which may have been added to.
+func generateMap(ctx context.Context, t *levelTerrain, w, h int, opts wfc.Options, pos []int32) (wfc.Plane, wfc.Plane, error) {
+	plane, err := wfc.GenerateContext(ctx, w, h, opts)
+	if err != nil {
+		return nil, nil, err
 	}
-	rules, weights := generateRules(inputMatrix)
-	plane := wfc(weights, rules, w, h)
-	for !planeHasLandPath(w, h, plane) {
-		plane = wfc(weights, rules, w, h)
+	if t.decorations == nil {
+		return plane, nil, nil
+	}
+
+	// the spawn patch is kept clear, and solid decorations must leave as
+	// much of the map reachable as the terrain alone has to
+	decorOpts := opts
+	decorOpts.Model = t.decorations.Model
+	decorOpts.Constraints = append(t.decorations.Constraints(plane),
+		wfc.Rect(int(pos[1])-spawnSize/2, int(pos[0])-spawnSize/2, spawnSize, spawnSize, wfc.Empty))
+	decorOpts.Validators = []wfc.Validator{func(decorations wfc.Plane) error {
+		return wfc.Validate(obstruct(plane, decorations), opts.Validators...)
+	}}
+	decorations, err := wfc.GenerateContext(ctx, w, h, decorOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plane, decorations, nil
+}
+
+// measureMap returns the metrics of a map as the snake sees it, with its
+// solid decorations in the way.
+func measureMap(terrain, decorations wfc.Plane, mode Mode) wfc.Metrics {
+	if decorations != nil {
+		terrain = obstruct(terrain, decorations)
 	}
-	pos := findSuitableStartingPosition(w, h, plane)
-	return plane, pos
+	return wfc.Measure(terrain, mode == ModeWrap)
 }
@@ -0,0 +1,34 @@
+package wfc
+
+import "math/bits"
+
+// wordsFor returns how many uint64 words are needed to hold n bits.
+func wordsFor(n int) int {
+	return (n + 63) / 64
+}
+
+func setBit(set []uint64, i int) {
+	set[i/64] |= 1 << (i % 64)
+}
+
+func clearBit(set []uint64, i int) {
+	set[i/64] &^= 1 << (i % 64)
+}
+
+func hasBit(set []uint64, i int) bool {
+	return set[i/64]&(1<<(i%64)) != 0
+}
+
+// nextBit returns the index of the first set bit at or after i, or -1.
+func nextBit(set []uint64, i int) int {
+	for k := i / 64; k < len(set); k++ {
+		w := set[k]
+		if k == i/64 {
+			w &= ^uint64(0) << (i % 64)
+		}
+		if w != 0 {
+			return k*64 + bits.TrailingZeros64(w)
+		}
+	}
+	return -1
+}
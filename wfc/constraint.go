@@ -0,0 +1,66 @@
+package wfc
+
+// Constraint restricts every cell of a rectangle to a set of tiles. The
+// constraints of a call to Generate are applied and propagated before the
+// first cell is collapsed, so the cells are guaranteed to end up with one
+// of their tiles.
+type Constraint struct {
+	X, Y, W, H int
+	Tiles      []Tile
+}
+
+// Pin restricts the cell at (x, y) to tiles.
+func Pin(x, y int, tiles ...Tile) Constraint {
+	return Constraint{X: x, Y: y, W: 1, H: 1, Tiles: tiles}
+}
+
+// Rect restricts the w by h rectangle at (x, y) to tiles.
+func Rect(x, y, w, h int, tiles ...Tile) Constraint {
+	return Constraint{X: x, Y: y, W: w, H: h, Tiles: tiles}
+}
+
+// Border restricts the outermost cells of a w by h plane to tiles.
+func Border(w, h int, tiles ...Tile) []Constraint {
+	return []Constraint{
+		Rect(0, 0, w, 1, tiles...),
+		Rect(0, h-1, w, 1, tiles...),
+		Rect(0, 1, 1, h-2, tiles...),
+		Rect(w-1, 1, 1, h-2, tiles...),
+	}
+}
+
+// constrain narrows the cells covered by the constraints down to the
+// patterns producing one of their tiles and propagates the result. Parts
+// of a constraint outside of the plane are ignored.
+func (s *solver) constrain(constraints []Constraint) error {
+	mask := make([]uint64, s.words)
+	var changed []int
+	for _, c := range constraints {
+		clear(mask)
+		for p, t := range s.m.tiles {
+			if containsTile(c.Tiles, t) {
+				setBit(mask, p)
+			}
+		}
+
+		for y := max(c.Y, 0); y < min(c.Y+c.H, s.h); y++ {
+			for x := max(c.X, 0); x < min(c.X+c.W, s.w); x++ {
+				i := y*s.w + x
+				if !s.narrow(i, mask) {
+					continue
+				}
+				if s.count[i] == 0 {
+					return s.contradiction(i)
+				}
+				changed = append(changed, i)
+			}
+		}
+	}
+
+	for _, i := range changed {
+		if err := s.propagate(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package wfc
+
+// entry is a cell queued for collapse with the entropy it had when queued.
+type entry struct {
+	entropy float64
+	cell    int
+}
+
+// entropyHeap is a binary min-heap of cells ordered by entropy. Cells are
+// pushed again whenever their entropy changes instead of being updated in
+// place, so stale entries have to be skipped when popping.
+type entropyHeap []entry
+
+func (h *entropyHeap) push(e entry) {
+	*h = append(*h, e)
+	q := *h
+	i := len(q) - 1
+	for i > 0 {
+		parent := (i - 1) / 2
+		if q[parent].entropy <= q[i].entropy {
+			break
+		}
+		q[parent], q[i] = q[i], q[parent]
+		i = parent
+	}
+}
+
+func (h *entropyHeap) pop() entry {
+	q := *h
+	top := q[0]
+	last := len(q) - 1
+	q[0] = q[last]
+	q = q[:last]
+	i := 0
+	for {
+		smallest := i
+		l, r := 2*i+1, 2*i+2
+		if l < len(q) && q[l].entropy < q[smallest].entropy {
+			smallest = l
+		}
+		if r < len(q) && q[r].entropy < q[smallest].entropy {
+			smallest = r
+		}
+		if smallest == i {
+			break
+		}
+		q[smallest], q[i] = q[i], q[smallest]
+		i = smallest
+	}
+	*h = q
+	return top
+}
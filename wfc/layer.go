@@ -0,0 +1,56 @@
+package wfc
+
+import "errors"
+
+var ErrLayerSize = errors.New("wfc: layer sample and terrain sample differ in size")
+
+// Layer generates a second plane on top of an existing one, typically
+// decorations over the terrain. Its model learns which decorations may
+// be next to each other as usual, and every decoration may only be placed
+// on the tiles it lies on in the sample.
+type Layer struct {
+	Model *Model
+	// on holds the decorations seen on every tile of the terrain sample
+	on map[Tile][]Tile
+}
+
+// NewLayer learns a layer from sample, where terrain is the plane sample
+// lies on and has the same size. Tiles of a generated plane never seen in
+// terrain can only carry Empty.
+func NewLayer(sample, terrain Plane, opts ModelOptions) (*Layer, error) {
+	if sample.Width() != terrain.Width() || sample.Height() != terrain.Height() {
+		return nil, ErrLayerSize
+	}
+	m, err := NewModel(sample, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Layer{Model: m, on: make(map[Tile][]Tile)}
+	for y, row := range sample {
+		for x, t := range row {
+			under := terrain[y][x]
+			if !containsTile(l.on[under], t) {
+				l.on[under] = append(l.on[under], t)
+			}
+		}
+	}
+	return l, nil
+}
+
+// Constraints returns the constraints keeping every cell of a plane
+// generated over p to the decorations allowed on its tile. They are meant
+// for Options.Constraints, next to any of the caller's own.
+func (l *Layer) Constraints(p Plane) []Constraint {
+	constraints := make([]Constraint, 0, p.Width()*p.Height())
+	for y, row := range p {
+		for x, t := range row {
+			allowed, ok := l.on[t]
+			if !ok {
+				allowed = []Tile{Empty}
+			}
+			constraints = append(constraints, Pin(x, y, allowed...))
+		}
+	}
+	return constraints
+}
@@ -0,0 +1,220 @@
+package wfc
+
+import "fmt"
+
+// Metrics describes how a plane plays, as far as the snake is concerned.
+type Metrics struct {
+	// Land, Coast, Sea and Rock are the shares of the plane covered by
+	// the passable tiles other than coast, by coast, by sea and rivers and
+	// by rocks.
+	Land, Coast, Sea, Rock float64
+	// Islands is how many separate areas of passable cells the plane has
+	// and Largest the share of the plane the biggest of them covers.
+	Islands int
+	Largest float64
+	// Corridor is the width of the narrowest passage between the parts of
+	// the largest area, see corridor. It is zero when no cell is passable.
+	Corridor int
+	// DeadEnds is how many passable cells have a single passable
+	// neighbour.
+	DeadEnds int
+}
+
+func (m Metrics) String() string {
+	return fmt.Sprintf("land %.0f%%, coast %.0f%%, sea %.0f%%, rock %.0f%%, %d islands, largest %.0f%%, corridor %d, %d dead ends",
+		m.Land*100, m.Coast*100, m.Sea*100, m.Rock*100, m.Islands, m.Largest*100, m.Corridor, m.DeadEnds)
+}
+
+// Measure computes the metrics of p. With wrap set the cells on opposite
+// edges are neighbours, except for Corridor which only looks at squares
+// within the plane.
+func Measure(p Plane, wrap bool) Metrics {
+	var m Metrics
+	w, h := p.Width(), p.Height()
+	if w == 0 || h == 0 {
+		return m
+	}
+
+	var land, coast, sea, rock int
+	for _, row := range p {
+		for _, t := range row {
+			switch t {
+			case Coast:
+				coast++
+			case Sea, River:
+				sea++
+			case Rock:
+				rock++
+			default:
+				land++
+			}
+		}
+	}
+	cells := float64(w * h)
+	m.Land, m.Coast, m.Sea, m.Rock = float64(land)/cells, float64(coast)/cells, float64(sea)/cells, float64(rock)/cells
+
+	// area numbers the passable cells by the area they belong to, from 1
+	area := make([]int, w*h)
+	largest, size := 0, 0
+	var stack []v2
+	for y, row := range p {
+		for x, t := range row {
+			if !Passable(t) {
+				continue
+			}
+
+			neighbours := 0
+			for _, d := range directions[:orthogonal] {
+				xx, yy, ok := neighbour(x, y, d, w, h, wrap)
+				if ok && Passable(p[yy][xx]) {
+					neighbours++
+				}
+			}
+			if neighbours == 1 {
+				m.DeadEnds++
+			}
+
+			if area[y*w+x] != 0 {
+				continue
+			}
+			m.Islands++
+			area[y*w+x] = m.Islands
+			stack = append(stack[:0], v2{x, y})
+			n := 0
+			for len(stack) != 0 {
+				c := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				n++
+				for _, d := range directions[:orthogonal] {
+					xx, yy, ok := neighbour(c.x, c.y, d, w, h, wrap)
+					if !ok || area[yy*w+xx] != 0 || !Passable(p[yy][xx]) {
+						continue
+					}
+					area[yy*w+xx] = m.Islands
+					stack = append(stack, v2{xx, yy})
+				}
+			}
+			if n > size {
+				largest, size = m.Islands, n
+			}
+		}
+	}
+	m.Largest = float64(size) / cells
+	if size != 0 {
+		m.Corridor = corridor(p, area, largest, wrap)
+	}
+
+	return m
+}
+
+// corridor returns the narrowest passage of area a. Keeping only the
+// cells of a lying in some k by k square of its cells, parts of it only
+// joined through passages narrower than k fall apart, while spurs and
+// bumps narrower than k just vanish. The passage is one narrower than the
+// first k at which a falls apart, or as wide as its widest square if it
+// never does.
+func corridor(p Plane, area []int, a int, wrap bool) int {
+	w, h := p.Width(), p.Height()
+	// square holds the side of the largest square whose bottom right
+	// corner is each cell, cover the side of the largest square each cell
+	// lies in
+	square := make([]int, w*h)
+	cover := make([]int, w*h)
+	widest := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if area[y*w+x] != a {
+				continue
+			}
+			s := 1
+			if x > 0 && y > 0 {
+				s += min(square[y*w+x-1], square[(y-1)*w+x], square[(y-1)*w+x-1])
+			}
+			square[y*w+x] = s
+			widest = max(widest, s)
+			for yy := y - s + 1; yy <= y; yy++ {
+				for xx := x - s + 1; xx <= x; xx++ {
+					cover[yy*w+xx] = max(cover[yy*w+xx], s)
+				}
+			}
+		}
+	}
+
+	seen := make([]bool, w*h)
+	var stack []int
+	for k := 2; k <= widest; k++ {
+		// flood the cells covered by k squares from the first of them
+		clear(seen)
+		cells, reached := 0, 0
+		for i, c := range cover {
+			if c < k {
+				continue
+			}
+			if cells++; cells == 1 {
+				seen[i] = true
+				stack = append(stack[:0], i)
+			}
+		}
+		for len(stack) != 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			reached++
+			for _, d := range directions[:orthogonal] {
+				xx, yy, ok := neighbour(i%w, i/w, d, w, h, wrap)
+				if ok && !seen[yy*w+xx] && cover[yy*w+xx] >= k {
+					seen[yy*w+xx] = true
+					stack = append(stack, yy*w+xx)
+				}
+			}
+		}
+		if reached != cells {
+			return k - 1
+		}
+	}
+	return widest
+}
+
+// Thresholds are the limits the Metrics of a plane must be within for it
+// to be accepted. Negative fields are not checked, so that a zero maximum
+// can ask for none at all.
+type Thresholds struct {
+	MinLand     float64
+	MaxSea      float64
+	MaxIslands  int
+	MinLargest  float64
+	MinCorridor int
+	MaxDeadEnds int
+}
+
+// NoThresholds checks nothing, it is where thresholds start from.
+var NoThresholds = Thresholds{
+	MinLand:     -1,
+	MaxSea:      -1,
+	MaxIslands:  -1,
+	MinLargest:  -1,
+	MinCorridor: -1,
+	MaxDeadEnds: -1,
+}
+
+// Accept rejects planes whose metrics, measured with wrap as for Measure,
+// are not within t.
+func Accept(t Thresholds, wrap bool) Validator {
+	return func(p Plane) error {
+		m := Measure(p, wrap)
+		switch {
+		case t.MinLand >= 0 && m.Land < t.MinLand:
+			return fmt.Errorf("%w: %.0f%% of the plane is land, want %.0f%%", ErrRejected, m.Land*100, t.MinLand*100)
+		case t.MaxSea >= 0 && m.Sea > t.MaxSea:
+			return fmt.Errorf("%w: %.0f%% of the plane is sea, want at most %.0f%%", ErrRejected, m.Sea*100, t.MaxSea*100)
+		case t.MaxIslands >= 0 && m.Islands > t.MaxIslands:
+			return fmt.Errorf("%w: %d islands, want at most %d", ErrRejected, m.Islands, t.MaxIslands)
+		case t.MinLargest >= 0 && m.Largest < t.MinLargest:
+			return fmt.Errorf("%w: the largest area covers %.0f%% of the plane, want %.0f%%", ErrRejected, m.Largest*100, t.MinLargest*100)
+		case t.MinCorridor >= 0 && m.Corridor < t.MinCorridor:
+			return fmt.Errorf("%w: the narrowest corridor is %d wide, want %d", ErrRejected, m.Corridor, t.MinCorridor)
+		case t.MaxDeadEnds >= 0 && m.DeadEnds > t.MaxDeadEnds:
+			return fmt.Errorf("%w: %d dead ends, want at most %d", ErrRejected, m.DeadEnds, t.MaxDeadEnds)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,133 @@
+package wfc
+
+import (
+	"errors"
+	"testing"
+)
+
+// plane builds a plane from rows of tile letters.
+func plane(rows ...string) Plane {
+	p := make(Plane, len(rows))
+	for y, row := range rows {
+		p[y] = []Tile(row)
+	}
+	return p
+}
+
+func TestMeasure(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Plane
+		wrap bool
+		want Metrics
+	}{
+		{"empty", Plane{}, false, Metrics{}},
+		{
+			"causeway",
+			plane(
+				"LLLLSSSSLLLL",
+				"LLLLSSSSLLLL",
+				"LLLLLLLLLLLL",
+				"LLLLSSSSLLLL",
+			),
+			false,
+			Metrics{Land: 36.0 / 48, Sea: 12.0 / 48, Islands: 1, Largest: 36.0 / 48, Corridor: 1},
+		},
+		{
+			"coast around a lake",
+			plane(
+				"LLLLLL",
+				"LCCCCL",
+				"LCSSCL",
+				"LCCCCL",
+				"LLLLLL",
+			),
+			false,
+			Metrics{Land: 18.0 / 30, Coast: 10.0 / 30, Sea: 2.0 / 30, Islands: 1, Largest: 28.0 / 30, Corridor: 2},
+		},
+		{
+			"rock trail",
+			plane(
+				"RRRRR",
+				"LFDBL",
+				"RRRRR",
+			),
+			false,
+			Metrics{Land: 5.0 / 15, Rock: 10.0 / 15, Islands: 1, Largest: 5.0 / 15, Corridor: 1, DeadEnds: 2},
+		},
+		{
+			"strips apart",
+			plane(
+				"LLSSSSLL",
+				"LLSSSSLL",
+			),
+			false,
+			Metrics{Land: 8.0 / 16, Sea: 8.0 / 16, Islands: 2, Largest: 4.0 / 16, Corridor: 2},
+		},
+		{
+			"strips wrapped",
+			plane(
+				"LLSSSSLL",
+				"LLSSSSLL",
+			),
+			true,
+			Metrics{Land: 8.0 / 16, Sea: 8.0 / 16, Islands: 1, Largest: 8.0 / 16, Corridor: 2},
+		},
+		{
+			"path",
+			plane(
+				"SLS",
+				"SLS",
+				"SLS",
+			),
+			false,
+			Metrics{Land: 3.0 / 9, Sea: 6.0 / 9, Islands: 1, Largest: 3.0 / 9, Corridor: 1, DeadEnds: 2},
+		},
+		{
+			"path wrapped",
+			plane(
+				"SLS",
+				"SLS",
+				"SLS",
+			),
+			true,
+			Metrics{Land: 3.0 / 9, Sea: 6.0 / 9, Islands: 1, Largest: 3.0 / 9, Corridor: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Measure(tt.p, tt.wrap); got != tt.want {
+				t.Errorf("Measure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	causeway := plane(
+		"LLLLSSSSLLLL",
+		"LLLLSSSSLLLL",
+		"LLLLLLLLLLLL",
+		"LLLLSSSSLLLL",
+	)
+	noSea := NoThresholds
+	noSea.MaxSea = 0
+	wide := NoThresholds
+	wide.MinCorridor = 2
+
+	tests := []struct {
+		name   string
+		t      Thresholds
+		reject bool
+	}{
+		{"nothing", NoThresholds, false},
+		{"no sea", noSea, true},
+		{"wide", wide, true},
+	}
+	for _, tt := range tests {
+		err := Accept(tt.t, false)(causeway)
+		if reject := errors.Is(err, ErrRejected); reject != tt.reject {
+			t.Errorf("%s: got %v, want rejected %v", tt.name, err, tt.reject)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package wfc
+
+import (
+	"errors"
+	"math"
+)
+
+var (
+	ErrEmptySample   = errors.New("wfc: empty sample")
+	ErrPatternTooBig = errors.New("wfc: pattern size does not fit the sample")
+)
+
+// ModelOptions configures how a model is learned from its sample.
+type ModelOptions struct {
+	// N is the pattern size of the overlapping model. Zero or one selects
+	// the simple tiled model, which only learns which tiles touch.
+	N int
+	// Symmetry adds transformed copies of the sample to learn from.
+	Symmetry Symmetry
+	// Diagonal learns and enforces which patterns may touch diagonally
+	// on top of the four orthogonal neighbours.
+	Diagonal bool
+}
+
+// Model holds the patterns, pattern frequencies and adjacency rules
+// learned from a sample. In the simple tiled model every pattern is a
+// single tile, in the overlapping model a pattern is an NxN window of the
+// sample whose top-left tile ends up in the plane.
+//
+// Rules are compiled into one bitset per pattern and direction holding
+// the patterns allowed next to it.
+type Model struct {
+	// tiles holds the tile every pattern produces, alphabet the distinct
+	// tiles in order of first appearance.
+	tiles    []Tile
+	alphabet []Tile
+	// counts holds how many times each pattern appeared in the sample,
+	// weights and weightLogs are the same as float64 ready for entropy.
+	counts     []uint
+	weights    []float64
+	weightLogs []float64
+	// n is the side of the patterns, words the length of every bitset
+	// over them and dirs how many of directions the rules cover.
+	n       int
+	words   int
+	dirs    int
+	allowed [len(directions)][]uint64
+	// pairs[d][i*len(tiles)+j] counts how many times pattern j was seen in
+	// direction d of pattern i, until finish turns the counts into how
+	// likely j is to be found there.
+	pairs [len(directions)][]float64
+}
+
+type v2 struct {
+	x, y int
+}
+
+// directions lists the neighbours of a cell, the orthogonal ones first.
+var directions = [...]v2{
+	{0, -1},  // up
+	{0, 1},   // down
+	{-1, 0},  // left
+	{1, 0},   // right
+	{-1, -1}, // up left
+	{1, -1},  // up right
+	{-1, 1},  // down left
+	{1, 1},   // down right
+}
+
+// orthogonal is how many of directions are orthogonal.
+const orthogonal = 4
+
+// neighbour returns the cell next to (x, y) in direction dir on a w by h
+// plane, wrapping around the edges when wrap is set. ok is false when
+// the neighbour is off the plane.
+func neighbour(x, y int, dir v2, w, h int, wrap bool) (xx, yy int, ok bool) {
+	xx, yy = x+dir.x, y+dir.y
+	if wrap {
+		return (xx + w) % w, (yy + h) % h, true
+	}
+	return xx, yy, xx >= 0 && yy >= 0 && xx < w && yy < h
+}
+
+// NewModel learns a model from sample. With opts.N below two it builds
+// the simple tiled model: every tile that appears next to another tile in
+// some direction is allowed to do so in the generated plane, and tiles
+// are weighted by how often they appear on their own and next to their
+// neighbours. Otherwise it builds the overlapping model, see
+// newOverlappingModel.
+func NewModel(sample Plane, opts ModelOptions) (*Model, error) {
+	if sample.Height() == 0 || sample.Width() == 0 {
+		return nil, ErrEmptySample
+	}
+	dirs := orthogonal
+	if opts.Diagonal {
+		dirs = len(directions)
+	}
+
+	samples := opts.Symmetry.apply(sample)
+	if opts.N > 1 {
+		return newOverlappingModel(samples, opts.N, dirs)
+	}
+
+	m := &Model{n: 1, dirs: dirs}
+	index := make(map[Tile]int)
+	for _, sample := range samples {
+		for _, row := range sample {
+			for _, tile := range row {
+				if _, ok := index[tile]; !ok {
+					index[tile] = len(m.tiles)
+					m.tiles = append(m.tiles, tile)
+					m.counts = append(m.counts, 0)
+				}
+				m.counts[index[tile]] += 1
+			}
+		}
+	}
+
+	m.compile()
+	for _, sample := range samples {
+		for y, row := range sample {
+			for x, tile := range row {
+				for d, dir := range directions[:m.dirs] {
+					xx, yy := x+dir.x, y+dir.y
+					if xx < 0 || yy < 0 || xx >= sample.Width() || yy >= sample.Height() {
+						continue
+					}
+					setBit(m.rule(d, index[tile]), index[sample[yy][xx]])
+					m.pairs[d][index[tile]*len(m.tiles)+index[sample[yy][xx]]]++
+				}
+			}
+		}
+	}
+	m.finish()
+
+	return m, nil
+}
+
+// compile sizes the rule table and derives the alphabet and weights from
+// the patterns and their counts.
+func (m *Model) compile() {
+	m.words = wordsFor(len(m.tiles))
+	for d := range m.allowed[:m.dirs] {
+		m.allowed[d] = make([]uint64, len(m.tiles)*m.words)
+		m.pairs[d] = make([]float64, len(m.tiles)*len(m.tiles))
+	}
+	m.weights = make([]float64, len(m.tiles))
+	m.weightLogs = make([]float64, len(m.tiles))
+	for i, c := range m.counts {
+		m.weights[i] = float64(c)
+		m.weightLogs[i] = float64(c) * math.Log(float64(c))
+	}
+	m.alphabet = nil
+	for _, t := range m.tiles {
+		if !containsTile(m.alphabet, t) {
+			m.alphabet = append(m.alphabet, t)
+		}
+	}
+}
+
+// finish turns the pair counts into the share of the neighbours of each
+// pattern in each direction, smoothed so that allowed pairs never seen
+// next to each other in the sample keep a small chance.
+func (m *Model) finish() {
+	n := len(m.tiles)
+	for d := range m.pairs[:m.dirs] {
+		for i := 0; i < n; i++ {
+			row := m.pairs[d][i*n : (i+1)*n]
+			total := float64(n)
+			for _, c := range row {
+				total += c
+			}
+			for j := range row {
+				row[j] = (row[j] + 1) / total
+			}
+		}
+	}
+}
+
+// pair returns how likely pattern j is to be found in direction d of
+// pattern i.
+func (m *Model) pair(d, i, j int) float64 {
+	return m.pairs[d][i*len(m.tiles)+j]
+}
+
+func containsTile(tiles []Tile, t Tile) bool {
+	for _, tt := range tiles {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the set of patterns allowed in direction d of pattern i.
+func (m *Model) rule(d, i int) []uint64 {
+	return m.allowed[d][i*m.words : (i+1)*m.words]
+}
+
+// Tiles returns the tile alphabet of the model in order of first appearance.
+func (m *Model) Tiles() []Tile {
+	return append([]Tile(nil), m.alphabet...)
+}
+
+// Patterns returns how many patterns the model learned. It equals the
+// length of Tiles for the simple tiled model.
+func (m *Model) Patterns() int {
+	return len(m.tiles)
+}
+
+// Weight returns how many times t appeared in the sample, counting the
+// patterns that produce it for the overlapping model.
+func (m *Model) Weight(t Tile) uint {
+	var w uint
+	for i, tt := range m.tiles {
+		if tt == t {
+			w += m.counts[i]
+		}
+	}
+	return w
+}
+
+// Reweight returns a copy of m sharing its rules, in which the patterns
+// producing each tile of scale are picked scale[t] times as often. The
+// weights of the other tiles are left as they are. Scales must be above
+// zero.
+func (m *Model) Reweight(scale map[Tile]float64) *Model {
+	r := *m
+	r.weights = make([]float64, len(m.weights))
+	r.weightLogs = make([]float64, len(m.weightLogs))
+	for i, t := range m.tiles {
+		w := m.weights[i]
+		if f, ok := scale[t]; ok {
+			w *= f
+		}
+		r.weights[i] = w
+		r.weightLogs[i] = w * math.Log(w)
+	}
+	return &r
+}
+
+// Allows reports whether other may be placed next to tile in direction
+// (dx, dy), which is diagonal only for models learned with Diagonal.
+func (m *Model) Allows(tile, other Tile, dx, dy int) bool {
+	for d, dir := range directions[:m.dirs] {
+		if dir.x != dx || dir.y != dy {
+			continue
+		}
+		for i, t := range m.tiles {
+			if t != tile {
+				continue
+			}
+			for j, o := range m.tiles {
+				if o == other && hasBit(m.rule(d, i), j) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
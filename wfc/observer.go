@@ -0,0 +1,54 @@
+package wfc
+
+// StepKind tells what happened to a cell in a Step.
+type StepKind uint8
+
+const (
+	// StepStart marks the start of an attempt, every cell has all the
+	// patterns of the model again. X and Y are zero.
+	StepStart StepKind = iota
+	// StepCollapse is a cell collapsed to a single pattern.
+	StepCollapse
+	// StepPropagate is a cell losing options to propagation or to a
+	// constraint.
+	StepPropagate
+	// StepContradiction is a cell left without options.
+	StepContradiction
+	// StepBacktrack is a cell restored or losing the pattern it was
+	// collapsed to while a decision is undone.
+	StepBacktrack
+)
+
+// Step is one change to a cell during generation.
+type Step struct {
+	Kind    StepKind
+	Attempt int
+	X, Y    int
+	// Options is how many patterns the cell has left.
+	Options int
+	// Tile is the tile of the cell once Options is one, zero otherwise.
+	Tile Tile
+}
+
+// Observer is called for every step of generation, from the goroutine
+// running the attempt. It must be safe for concurrent use when
+// Options.Workers is above one.
+type Observer func(Step)
+
+func (s *solver) emit(kind StepKind, i int) {
+	if s.observer == nil {
+		return
+	}
+
+	st := Step{
+		Kind:    kind,
+		Attempt: s.attempt,
+		X:       i % s.w,
+		Y:       i / s.w,
+		Options: s.count[i],
+	}
+	if s.count[i] == 1 {
+		st.Tile = s.m.tiles[nextBit(s.cell(i), 0)]
+	}
+	s.observer(st)
+}
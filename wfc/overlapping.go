@@ -0,0 +1,80 @@
+package wfc
+
+// newOverlappingModel learns every n by n window of samples as a pattern.
+// Two patterns may be neighbours in a direction when they agree on the
+// tiles they overlap once shifted by it, which carries the shapes of the
+// sample over into the plane instead of just its tile pairs. Patterns
+// found next to each other in the sample are counted as pairs like tiles
+// in the simple model.
+func newOverlappingModel(samples []Plane, n, dirs int) (*Model, error) {
+	m := &Model{n: n, dirs: dirs}
+	var patterns [][]Tile
+	index := make(map[string]int)
+	// at holds the pattern of every window of every sample
+	at := make([][][]int, len(samples))
+	for si, sample := range samples {
+		if n > sample.Width() || n > sample.Height() {
+			return nil, ErrPatternTooBig
+		}
+		at[si] = make([][]int, sample.Height()-n+1)
+		for y := 0; y <= sample.Height()-n; y++ {
+			at[si][y] = make([]int, sample.Width()-n+1)
+			for x := 0; x <= sample.Width()-n; x++ {
+				p := make([]Tile, 0, n*n)
+				for yy := y; yy < y+n; yy++ {
+					p = append(p, sample[yy][x:x+n]...)
+				}
+
+				k := string(p)
+				i, ok := index[k]
+				if !ok {
+					i = len(patterns)
+					index[k] = i
+					patterns = append(patterns, p)
+					m.tiles = append(m.tiles, p[0])
+					m.counts = append(m.counts, 0)
+				}
+				m.counts[i] += 1
+				at[si][y][x] = i
+			}
+		}
+	}
+
+	m.compile()
+	for d, dir := range directions[:m.dirs] {
+		for i, p := range patterns {
+			for j, q := range patterns {
+				if agrees(p, q, n, dir) {
+					setBit(m.rule(d, i), j)
+				}
+			}
+		}
+		for _, windows := range at {
+			for y, row := range windows {
+				for x, i := range row {
+					xx, yy := x+dir.x, y+dir.y
+					if xx < 0 || yy < 0 || yy >= len(windows) || xx >= len(row) {
+						continue
+					}
+					m.pairs[d][i*len(m.tiles)+windows[yy][xx]]++
+				}
+			}
+		}
+	}
+	m.finish()
+
+	return m, nil
+}
+
+// agrees reports whether q may sit at offset dir from p, that is whether
+// both patterns have the same tiles where they overlap.
+func agrees(p, q []Tile, n int, dir v2) bool {
+	for y := max(0, dir.y); y < min(n, n+dir.y); y++ {
+		for x := max(0, dir.x); x < min(n, n+dir.x); x++ {
+			if p[y*n+x] != q[(y-dir.y)*n+x-dir.x] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package wfc
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrRegionTooBig = errors.New("wfc: region does not fit in the plane")
+
+// Regenerate collapses the w by h rectangle at (x, y) of p again with the
+// rules of opts.Model, leaving the rest of p as it is. The tiles around
+// the rectangle are pinned while it collapses, so the new tiles fit in
+// with their surroundings.
+//
+// opts.Constraints are given in the coordinates of p, opts.Validators
+// see the whole updated plane and opts.Periodic lets the rectangle wrap
+// around the edges of p. opts.Observer is ignored. p itself is not
+// modified.
+func Regenerate(ctx context.Context, p Plane, x, y, w, h int, opts Options) (Plane, error) {
+	pw, ph := p.Width(), p.Height()
+	// a pattern covers n cells in every direction, the cells that far
+	// from the rectangle are the ones its patterns may overlap
+	margin := max(opts.Model.n-1, 1)
+
+	// the sub-plane that is generated: the rectangle and its margin
+	ox, oy := x-margin, y-margin
+	sw, sh := w+2*margin, h+2*margin
+	if opts.Periodic {
+		if sw > pw || sh > ph {
+			return nil, ErrRegionTooBig
+		}
+	} else {
+		ox, oy = max(ox, 0), max(oy, 0)
+		sw, sh = min(x+w+margin, pw)-ox, min(y+h+margin, ph)-oy
+	}
+	if sw <= 0 || sh <= 0 {
+		return nil, ErrRegionTooBig
+	}
+
+	// toPlane and toSub convert between coordinates of p and of the
+	// sub-plane
+	toPlane := func(i, j int) (int, int) {
+		return (ox + i + pw) % pw, (oy + j + ph) % ph
+	}
+	offset := func(c, o, size int) int {
+		if opts.Periodic {
+			return ((c-o)%size + size) % size
+		}
+		return c - o
+	}
+	toSub := func(cx, cy int) (int, int, bool) {
+		i, j := offset(cx, ox, pw), offset(cy, oy, ph)
+		return i, j, i >= 0 && j >= 0 && i < sw && j < sh
+	}
+
+	sub := opts
+	sub.Periodic = false
+	sub.Observer = nil
+	sub.Constraints = nil
+	for j := 0; j < sh; j++ {
+		for i := 0; i < sw; i++ {
+			cx, cy := toPlane(i, j)
+			if rx, ry := offset(cx, x, pw), offset(cy, y, ph); rx < 0 || ry < 0 || rx >= w || ry >= h {
+				sub.Constraints = append(sub.Constraints, Pin(i, j, p[cy][cx]))
+			}
+		}
+	}
+	for _, c := range opts.Constraints {
+		for cy := max(c.Y, 0); cy < min(c.Y+c.H, ph); cy++ {
+			for cx := max(c.X, 0); cx < min(c.X+c.W, pw); cx++ {
+				if i, j, ok := toSub(cx, cy); ok {
+					sub.Constraints = append(sub.Constraints, Pin(i, j, c.Tiles...))
+				}
+			}
+		}
+	}
+
+	paste := func(s Plane) Plane {
+		out := make(Plane, ph)
+		for cy := range out {
+			out[cy] = append([]Tile(nil), p[cy]...)
+		}
+		for j, row := range s {
+			for i, t := range row {
+				cx, cy := toPlane(i, j)
+				out[cy][cx] = t
+			}
+		}
+		return out
+	}
+	if len(opts.Validators) != 0 {
+		sub.Validators = []Validator{func(s Plane) error {
+			return Validate(paste(s), opts.Validators...)
+		}}
+	}
+
+	s, err := GenerateContext(ctx, sw, sh, sub)
+	if err != nil {
+		return nil, err
+	}
+	return paste(s), nil
+}
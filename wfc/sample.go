@@ -0,0 +1,157 @@
+package wfc
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Palette maps the colours of a sample image to tiles.
+type Palette map[color.RGBA]Tile
+
+// DefaultPalette is used by LoadSample for image samples.
+var DefaultPalette = Palette{
+	{128, 160, 107, 255}: Land,
+	{230, 210, 150, 255}: Coast,
+	{60, 110, 170, 255}:  Sea,
+	{60, 110, 60, 255}:   Forest,
+	{120, 120, 120, 255}: Rock,
+	{240, 230, 180, 255}: Sand,
+	{90, 150, 210, 255}:  River,
+	{140, 90, 50, 255}:   Bridge,
+}
+
+// ReadSample parses an ASCII terrain sample: one row of tiles per line
+// using the letters of the terrain tile constants. Blank lines and lines
+// starting with '#' are skipped.
+func ReadSample(r io.Reader) (Plane, error) {
+	return readPlane(r, "terrain", Tile.Terrain)
+}
+
+// ReadDecorations parses an ASCII decoration sample, written like a
+// terrain sample with the letters of the decoration constants.
+func ReadDecorations(r io.Reader) (Plane, error) {
+	return readPlane(r, "decoration", Tile.Decoration)
+}
+
+// readPlane parses rows of tiles for which valid holds, kind names them
+// in errors.
+func readPlane(r io.Reader, kind string, valid func(Tile) bool) (Plane, error) {
+	var sample Plane
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		row := make([]Tile, len(text))
+		for x := range text {
+			t := Tile(text[x])
+			if !valid(t) {
+				return nil, fmt.Errorf("wfc: line %d: %q is not a %s tile", line, text[x], kind)
+			}
+			row[x] = t
+		}
+		if len(sample) > 0 && len(row) != sample.Width() {
+			return nil, fmt.Errorf("wfc: line %d: row has %d tiles, want %d", line, len(row), sample.Width())
+		}
+		sample = append(sample, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sample) == 0 {
+		return nil, ErrEmptySample
+	}
+
+	return sample, nil
+}
+
+// DecodeSample reads a sample from an image, one tile per pixel.
+func DecodeSample(img image.Image, palette Palette) (Plane, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, ErrEmptySample
+	}
+
+	sample := make(Plane, b.Dy())
+	for y := range sample {
+		sample[y] = make([]Tile, b.Dx())
+		for x := range sample[y] {
+			c := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+			t, ok := palette[c]
+			if !ok {
+				return nil, fmt.Errorf("wfc: pixel (%d, %d): colour #%02x%02x%02x is not in the palette", x, y, c.R, c.G, c.B)
+			}
+			sample[y][x] = t
+		}
+	}
+
+	return sample, nil
+}
+
+// LoadSample reads a sample file: PNG images are decoded with
+// DefaultPalette, anything else is parsed as ASCII.
+func LoadSample(path string) (Plane, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".png") {
+		img, err := png.Decode(f)
+		if err != nil {
+			return nil, fmt.Errorf("wfc: %s: %w", path, err)
+		}
+		return DecodeSample(img, DefaultPalette)
+	}
+	return ReadSample(f)
+}
+
+// WritePlane writes p in the ASCII format ReadSample reads, one row of
+// tiles per line.
+func WritePlane(w io.Writer, p Plane) error {
+	bw := bufio.NewWriter(w)
+	for _, row := range p {
+		bw.WriteString(string(row))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// EncodeImage draws p with a scale by scale square per tile in its colour
+// in palette, tiles missing from it are left transparent. At scale 1 the
+// image reads back with DecodeSample.
+func EncodeImage(p Plane, palette Palette, scale int) *image.RGBA {
+	colours := make(map[Tile]color.RGBA, len(palette))
+	for c, t := range palette {
+		colours[t] = c
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, p.Width()*scale, p.Height()*scale))
+	for y, row := range p {
+		for x, t := range row {
+			c, ok := colours[t]
+			if !ok {
+				continue
+			}
+			for yy := y * scale; yy < (y+1)*scale; yy++ {
+				for xx := x * scale; xx < (x+1)*scale; xx++ {
+					img.SetRGBA(xx, yy, c)
+				}
+			}
+		}
+	}
+
+	return img
+}
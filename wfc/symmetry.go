@@ -0,0 +1,70 @@
+package wfc
+
+// Symmetry selects transformed copies of a sample a model learns from in
+// addition to the sample itself.
+type Symmetry uint8
+
+const (
+	// Mirror adds the sample flipped left to right.
+	Mirror Symmetry = 1 << iota
+	// Rotate adds the sample rotated by 90, 180 and 270 degrees.
+	Rotate
+	// Reverse adds the sample flipped upside down.
+	Reverse
+)
+
+// apply returns sample followed by the copies selected by s. The sample
+// itself is never modified.
+func (s Symmetry) apply(sample Plane) []Plane {
+	samples := []Plane{sample}
+	if s&Reverse != 0 {
+		samples = append(samples, sample.Reverse())
+	}
+	if s&Mirror != 0 {
+		for _, p := range samples {
+			samples = append(samples, p.Mirror())
+		}
+	}
+	if s&Rotate != 0 {
+		for _, p := range samples {
+			for i := 0; i < 3; i++ {
+				p = p.Rotate()
+				samples = append(samples, p)
+			}
+		}
+	}
+	return samples
+}
+
+// Mirror returns a copy of p flipped left to right.
+func (p Plane) Mirror() Plane {
+	out := make(Plane, p.Height())
+	for y, row := range p {
+		out[y] = make([]Tile, len(row))
+		for x, t := range row {
+			out[y][len(row)-1-x] = t
+		}
+	}
+	return out
+}
+
+// Reverse returns a copy of p flipped upside down.
+func (p Plane) Reverse() Plane {
+	out := make(Plane, p.Height())
+	for y, row := range p {
+		out[p.Height()-1-y] = append([]Tile(nil), row...)
+	}
+	return out
+}
+
+// Rotate returns a copy of p rotated 90 degrees clockwise.
+func (p Plane) Rotate() Plane {
+	out := make(Plane, p.Width())
+	for x := range out {
+		out[x] = make([]Tile, p.Height())
+		for y := range p {
+			out[x][p.Height()-1-y] = p[y][x]
+		}
+	}
+	return out
+}
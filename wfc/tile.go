@@ -0,0 +1,59 @@
+package wfc
+
+// Tile is a single cell of a sample or a generated plane.
+type Tile uint8
+
+const (
+	Land   Tile = 'L'
+	Coast  Tile = 'C'
+	Sea    Tile = 'S'
+	Forest Tile = 'F'
+	Rock   Tile = 'R'
+	Sand   Tile = 'D'
+	River  Tile = 'W'
+	Bridge Tile = 'B'
+)
+
+// Decorations are placed over the terrain by a Layer.
+const (
+	Empty   Tile = '.'
+	Tree    Tile = 't'
+	Boulder Tile = 'o'
+	Shell   Tile = 's'
+	Hut     Tile = 'h'
+)
+
+// terrainTiles lists the tiles a terrain sample may use, decorationTiles
+// those of a decoration sample.
+var (
+	terrainTiles    = []Tile{Land, Coast, Sea, Forest, Rock, Sand, River, Bridge}
+	decorationTiles = []Tile{Empty, Tree, Boulder, Shell, Hut}
+)
+
+// Terrain reports whether t is one of the terrain tile constants.
+func (t Tile) Terrain() bool {
+	return containsTile(terrainTiles, t)
+}
+
+// Decoration reports whether t is one of the decoration constants.
+func (t Tile) Decoration() bool {
+	return containsTile(decorationTiles, t)
+}
+
+func (t Tile) String() string {
+	return string(rune(t))
+}
+
+// Plane is a grid of tiles indexed as plane[y][x].
+type Plane [][]Tile
+
+func (p Plane) Width() int {
+	if len(p) == 0 {
+		return 0
+	}
+	return len(p[0])
+}
+
+func (p Plane) Height() int {
+	return len(p)
+}
@@ -0,0 +1,90 @@
+package wfc
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrRejected = errors.New("wfc: plane rejected")
+
+// Validator checks a generated plane, returning an error wrapping
+// ErrRejected when it is not good enough to play on.
+type Validator func(Plane) error
+
+// Validate runs validators against p and returns the first rejection.
+func Validate(p Plane, validators ...Validator) error {
+	for _, v := range validators {
+		if err := v(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Passable reports whether the snake can move onto t. Rivers can only be
+// crossed at bridges.
+func Passable(t Tile) bool {
+	return t != Sea && t != Rock && t != River
+}
+
+// Reachable returns how many passable cells can be reached from (x, y)
+// moving up, down, left and right, including (x, y) itself.
+func Reachable(p Plane, x, y int) int {
+	return reachable(p, x, y, false)
+}
+
+// ReachableWrapped is Reachable on a plane wrapping around its edges.
+func ReachableWrapped(p Plane, x, y int) int {
+	return reachable(p, x, y, true)
+}
+
+func reachable(p Plane, x, y int, wrap bool) int {
+	if x < 0 || y < 0 || x >= p.Width() || y >= p.Height() || !Passable(p[y][x]) {
+		return 0
+	}
+
+	seen := make([]bool, p.Width()*p.Height())
+	seen[y*p.Width()+x] = true
+	stack := []v2{{x, y}}
+	n := 0
+	for len(stack) != 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n++
+
+		for _, d := range directions[:orthogonal] {
+			xx, yy, ok := neighbour(c.x, c.y, d, p.Width(), p.Height(), wrap)
+			if !ok {
+				continue
+			}
+			i := yy*p.Width() + xx
+			if seen[i] || !Passable(p[yy][xx]) {
+				continue
+			}
+			seen[i] = true
+			stack = append(stack, v2{xx, yy})
+		}
+	}
+	return n
+}
+
+// MinReachable rejects planes where less than share, between 0 and 1, of
+// all cells can be reached from (x, y).
+func MinReachable(x, y int, share float64) Validator {
+	return minReachable(x, y, share, false)
+}
+
+// MinReachableWrapped is MinReachable on a plane wrapping around its edges.
+func MinReachableWrapped(x, y int, share float64) Validator {
+	return minReachable(x, y, share, true)
+}
+
+func minReachable(x, y int, share float64, wrap bool) Validator {
+	return func(p Plane) error {
+		got := float64(reachable(p, x, y, wrap)) / float64(p.Width()*p.Height())
+		if got < share {
+			return fmt.Errorf("%w: %.0f%% of the plane is reachable from (%d, %d), want %.0f%%", ErrRejected, got*100, x, y, share*100)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,494 @@
+// Package wfc implements the wave function collapse algorithm used to
+// generate the terrain of the snake game.
+package wfc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sync"
+)
+
+// DefaultMaxBacktracks is used when Options.MaxBacktracks is zero.
+const DefaultMaxBacktracks = 1000
+
+// cancelCheckInterval is how many cells are collapsed between checks of
+// the context passed to GenerateContext.
+const cancelCheckInterval = 64
+
+var ErrContradiction = errors.New("wfc: contradiction")
+
+// ContradictionError is returned by Generate when a cell runs out of
+// options and backtracking could not recover from it.
+type ContradictionError struct {
+	X, Y       int
+	Backtracks int
+}
+
+func (e *ContradictionError) Error() string {
+	return fmt.Sprintf("wfc: contradiction at (%d, %d) after %d backtracks", e.X, e.Y, e.Backtracks)
+}
+
+func (e *ContradictionError) Unwrap() error {
+	return ErrContradiction
+}
+
+// GenerationError is returned by GenerateContext when no attempt produced
+// a valid plane. Err is the reason the last attempt failed: a
+// *ContradictionError, a rejection by a validator or the error of the
+// context.
+type GenerationError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *GenerationError) Error() string {
+	return fmt.Sprintf("wfc: no valid plane after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *GenerationError) Unwrap() error {
+	return e.Err
+}
+
+// Options configures a call to Generate.
+type Options struct {
+	// Model holds the rules to generate with. It must not be nil.
+	Model *Model
+	// Seed seeds every random choice made, generating with the same
+	// options and seed always yields the same plane.
+	Seed int64
+	// Periodic makes the plane wrap around: the tiles on opposite edges
+	// are neighbours and have to match like any other.
+	Periodic bool
+	// Constraints restrict cells to some of the tiles before generation
+	// starts, e.g. to keep a spawn area on land.
+	Constraints []Constraint
+	// MaxBacktracks limits how many times a contradiction may be undone
+	// before an attempt gives up. Zero means DefaultMaxBacktracks and a
+	// negative value disables backtracking.
+	MaxBacktracks int
+	// Validators accept or reject a collapsed plane.
+	Validators []Validator
+	// Attempts is how many planes may be generated before giving up, one
+	// when zero.
+	Attempts int
+	// Workers is how many attempts may run concurrently, one when zero.
+	// Validators must be safe to call from several goroutines when it is
+	// above one.
+	Workers int
+	// Observer is told about every change made to the plane, e.g. to
+	// animate generation or debug a rule set.
+	Observer Observer
+}
+
+// decision is a collapse that can be undone by rolling the trail back to
+// its length at the time the decision was made.
+type decision struct {
+	cell  int
+	tile  int
+	trail int
+}
+
+// solver holds the wave: every cell is a bitset over the tiles of the
+// model, stored back to back in one slice so that generation does not
+// allocate once the solver is set up.
+type solver struct {
+	m     *Model
+	rng   *rand.Rand
+	w, h  int
+	words int
+	wave  []uint64
+	count []int
+	// sumW and sumWLog cache the sums of the weights and weight logs of
+	// the options left in every cell, noise breaks ties between cells with
+	// the same entropy. queue orders the undecided cells by entropy.
+	sumW    []float64
+	sumWLog []float64
+	noise   []float64
+	queue   entropyHeap
+	// trail records the cells changed since the start, trailWords the
+	// bitsets they had before the change.
+	trail      []int
+	trailWords []uint64
+	decisions  []decision
+	stack      []int
+	union      []uint64
+	// bias holds the weight of every option of the cell being collapsed
+	bias []float64
+	// backtracks counts undone decisions, budget is how many are allowed.
+	backtracks int
+	budget     int
+	observer   Observer
+	attempt    int
+	// periodic makes the plane wrap around its edges
+	periodic bool
+}
+
+func newSolver(m *Model, w, h int, seed int64) *solver {
+	s := &solver{
+		m:     m,
+		rng:   rand.New(rand.NewSource(seed)),
+		w:     w,
+		h:     h,
+		words: m.words,
+		wave:  make([]uint64, w*h*m.words),
+		count: make([]int, w*h),
+		union: make([]uint64, m.words),
+		bias:  make([]float64, len(m.tiles)),
+	}
+	s.sumW = make([]float64, w*h)
+	s.sumWLog = make([]float64, w*h)
+	s.noise = make([]float64, w*h)
+	s.queue = make(entropyHeap, 0, w*h)
+	for i := range s.count {
+		for t := range m.tiles {
+			setBit(s.cell(i), t)
+		}
+		s.noise[i] = s.rng.Float64() / 1000
+		s.refresh(i)
+	}
+	return s
+}
+
+func (s *solver) cell(i int) []uint64 {
+	return s.wave[i*s.words : (i+1)*s.words]
+}
+
+// save records the current options of cell i on the trail.
+func (s *solver) save(i int) {
+	s.trail = append(s.trail, i)
+	s.trailWords = append(s.trailWords, s.cell(i)...)
+}
+
+// undo restores every cell changed since the trail had length n.
+func (s *solver) undo(n int) {
+	for len(s.trail) > n {
+		i := s.trail[len(s.trail)-1]
+		s.trail = s.trail[:len(s.trail)-1]
+		old := s.trailWords[len(s.trailWords)-s.words:]
+		s.trailWords = s.trailWords[:len(s.trailWords)-s.words]
+		copy(s.cell(i), old)
+		s.refresh(i)
+		s.emit(StepBacktrack, i)
+	}
+}
+
+func (s *solver) contradiction(i int) error {
+	return &ContradictionError{X: i % s.w, Y: i / s.w}
+}
+
+// entropy returns the Shannon entropy of cell i.
+func (s *solver) entropy(i int) float64 {
+	return math.Log(s.sumW[i]) - s.sumWLog[i]/s.sumW[i] - s.noise[i]
+}
+
+// refresh recomputes the cached state of cell i from its options and
+// queues it again when it is still undecided.
+func (s *solver) refresh(i int) {
+	options := s.cell(i)
+	s.count[i] = 0
+	s.sumW[i] = 0
+	s.sumWLog[i] = 0
+	for t := nextBit(options, 0); t != -1; t = nextBit(options, t+1) {
+		s.count[i]++
+		s.sumW[i] += s.m.weights[t]
+		s.sumWLog[i] += s.m.weightLogs[t]
+	}
+	if s.count[i] > 1 {
+		s.queue.push(entry{s.entropy(i), i})
+	}
+}
+
+// lowestEntropy returns the undecided cell with the lowest Shannon
+// entropy, or -1 once every cell is collapsed.
+func (s *solver) lowestEntropy() int {
+	for len(s.queue) != 0 {
+		e := s.queue.pop()
+		if s.count[e.cell] > 1 && e.entropy == s.entropy(e.cell) {
+			return e.cell
+		}
+	}
+
+	return -1
+}
+
+// collapse picks one of the options of cell i at random. Options are
+// weighted by how often they appear in the sample and how often they
+// appear next to the neighbours already decided.
+func (s *solver) collapse(i int) {
+	options := s.cell(i)
+	x, y := i%s.w, i/s.w
+
+	totalWeight := 0.0
+	for t := nextBit(options, 0); t != -1; t = nextBit(options, t+1) {
+		s.bias[t] = s.m.weights[t]
+		for d, dir := range directions[:s.m.dirs] {
+			xx, yy, ok := neighbour(x, y, dir, s.w, s.h, s.periodic)
+			if ok && s.count[yy*s.w+xx] == 1 {
+				s.bias[t] *= s.m.pair(d, t, nextBit(s.cell(yy*s.w+xx), 0))
+			}
+		}
+		totalWeight += s.bias[t]
+	}
+
+	totalWeight = totalWeight * s.rng.Float64()
+
+	pick := nextBit(options, 0)
+	for t := pick; t != -1; t = nextBit(options, t+1) {
+		totalWeight -= s.bias[t]
+		if totalWeight < 0 {
+			pick = t
+			break
+		}
+	}
+
+	s.decisions = append(s.decisions, decision{i, pick, len(s.trail)})
+	s.save(i)
+	clear(options)
+	setBit(options, pick)
+	s.count[i] = 1
+	s.sumW[i] = s.m.weights[pick]
+	s.sumWLog[i] = s.m.weightLogs[pick]
+	s.emit(StepCollapse, i)
+}
+
+// narrow removes the options of cell i missing from mask, saving the cell
+// on the trail first. It reports whether anything was removed.
+func (s *solver) narrow(i int, mask []uint64) bool {
+	options := s.cell(i)
+	changed := false
+	for k, word := range options {
+		if word&^mask[k] != 0 {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return false
+	}
+
+	s.save(i)
+	for k := range options {
+		removed := options[k] &^ mask[k]
+		for removed != 0 {
+			t := k*64 + bits.TrailingZeros64(removed)
+			removed &= removed - 1
+			s.count[i]--
+			s.sumW[i] -= s.m.weights[t]
+			s.sumWLog[i] -= s.m.weightLogs[t]
+		}
+		options[k] &= mask[k]
+	}
+	if s.count[i] > 1 {
+		s.queue.push(entry{s.entropy(i), i})
+	}
+	if s.count[i] == 0 {
+		s.emit(StepContradiction, i)
+	} else {
+		s.emit(StepPropagate, i)
+	}
+	return true
+}
+
+func (s *solver) propagate(i int) error {
+	s.stack = append(s.stack[:0], i)
+
+	for len(s.stack) != 0 {
+		cur := s.stack[len(s.stack)-1]
+		s.stack = s.stack[:len(s.stack)-1]
+		x, y := cur%s.w, cur/s.w
+		tiles := s.cell(cur)
+
+		for d, dir := range directions[:s.m.dirs] {
+			xx, yy, ok := neighbour(x, y, dir, s.w, s.h, s.periodic)
+			if !ok {
+				continue
+			}
+			next := yy*s.w + xx
+
+			clear(s.union)
+			for t := nextBit(tiles, 0); t != -1; t = nextBit(tiles, t+1) {
+				for k, word := range s.m.rule(d, t) {
+					s.union[k] |= word
+				}
+			}
+
+			if !s.narrow(next, s.union) {
+				continue
+			}
+			if s.count[next] == 0 {
+				return s.contradiction(next)
+			}
+			s.stack = append(s.stack, next)
+		}
+	}
+
+	return nil
+}
+
+// backtrack undoes the most recent decision and bans the tile it picked,
+// going further back whenever that leaves the plane contradictory.
+func (s *solver) backtrack(err error) error {
+	for err != nil {
+		if s.backtracks >= s.budget || len(s.decisions) == 0 {
+			var ce *ContradictionError
+			if errors.As(err, &ce) {
+				ce.Backtracks = s.backtracks
+			}
+			return err
+		}
+		s.backtracks++
+
+		d := s.decisions[len(s.decisions)-1]
+		s.decisions = s.decisions[:len(s.decisions)-1]
+		s.undo(d.trail)
+
+		s.save(d.cell)
+		clearBit(s.cell(d.cell), d.tile)
+		s.refresh(d.cell)
+		s.emit(StepBacktrack, d.cell)
+		if s.count[d.cell] == 0 {
+			err = s.contradiction(d.cell)
+			continue
+		}
+		err = s.propagate(d.cell)
+	}
+
+	return nil
+}
+
+func (s *solver) plane() Plane {
+	out := make(Plane, s.h)
+	for y := range out {
+		out[y] = make([]Tile, s.w)
+		for x := range out[y] {
+			out[y][x] = s.m.tiles[nextBit(s.cell(y*s.w+x), 0)]
+		}
+	}
+	return out
+}
+
+// generate makes a single attempt at collapsing a w by h plane.
+func generate(ctx context.Context, w, h int, opts Options, attempt int, seed int64) (Plane, error) {
+	s := newSolver(opts.Model, w, h, seed)
+	s.observer = opts.Observer
+	s.attempt = attempt
+	s.periodic = opts.Periodic
+	if s.observer != nil {
+		s.observer(Step{Kind: StepStart, Attempt: attempt, Options: s.m.Patterns()})
+	}
+	s.budget = opts.MaxBacktracks
+	if s.budget == 0 {
+		s.budget = DefaultMaxBacktracks
+	} else if s.budget < 0 {
+		s.budget = 0
+	}
+
+	if err := s.constrain(opts.Constraints); err != nil {
+		return nil, err
+	}
+
+	steps := 0
+	for c := s.lowestEntropy(); c != -1; c = s.lowestEntropy() {
+		if steps++; steps%cancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		s.collapse(c)
+		if err := s.backtrack(s.propagate(c)); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.plane(), nil
+}
+
+// Generate collapses a w by h plane using the rules of opts.Model, see
+// GenerateContext.
+func Generate(w, h int, opts Options) (Plane, error) {
+	return GenerateContext(context.Background(), w, h, opts)
+}
+
+// GenerateContext collapses a w by h plane using the rules of opts.Model.
+// When a cell runs out of options, the decisions leading up to it are
+// undone and retried with other tiles; the attempt fails once
+// opts.MaxBacktracks is exhausted, or right away when opts.Constraints
+// cannot be satisfied. Planes rejected by opts.Validators fail the
+// attempt as well.
+//
+// Failed attempts are retried with new seeds derived from opts.Seed until
+// opts.Attempts is used up or ctx is done, after which a
+// *GenerationError is returned. With opts.Workers above one, that many
+// attempts run at the same time and later attempts are cancelled as soon
+// as one succeeds. The first valid attempt in seed order always wins, so
+// the plane does not depend on the number of workers or their timing.
+func GenerateContext(ctx context.Context, w, h int, opts Options) (Plane, error) {
+	attempts := max(opts.Attempts, 1)
+	workers := min(max(opts.Workers, 1), attempts)
+
+	seeds := make([]int64, attempts)
+	rng := rand.New(rand.NewSource(opts.Seed))
+	seeds[0] = opts.Seed
+	for i := 1; i < attempts; i++ {
+		seeds[i] = rng.Int63()
+	}
+
+	var (
+		mu sync.Mutex
+		// next is the next attempt to start, winner the first attempt
+		// that produced a valid plane so far
+		next    int
+		winner  = attempts
+		plane   Plane
+		errs    = make([]error, attempts)
+		cancels = make([]context.CancelFunc, attempts)
+		wg      sync.WaitGroup
+	)
+	for k := 0; k < workers; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i := next
+				if i >= winner || ctx.Err() != nil {
+					mu.Unlock()
+					return
+				}
+				next++
+				attemptCtx, cancel := context.WithCancel(ctx)
+				cancels[i] = cancel
+				mu.Unlock()
+
+				p, err := generate(attemptCtx, w, h, opts, i, seeds[i])
+				if err == nil {
+					err = Validate(p, opts.Validators...)
+				}
+				cancel()
+
+				mu.Lock()
+				errs[i] = err
+				if err == nil && i < winner {
+					winner, plane = i, p
+					for j := i + 1; j < next; j++ {
+						cancels[j]()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if winner < attempts {
+		return plane, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &GenerationError{Attempts: next, Err: err}
+	}
+	return nil, &GenerationError{Attempts: next, Err: errs[next-1]}
+}
@@ -0,0 +1,595 @@
+package wfc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTestSample(tb testing.TB, name string) Plane {
+	tb.Helper()
+	p, err := LoadSample("../assets/samples/" + name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+// checkAllows fails unless every pair of neighbours of p in the
+// directions of m is allowed by m.
+func checkAllows(t *testing.T, m *Model, p Plane, wrap bool) {
+	t.Helper()
+	for y, row := range p {
+		for x, tile := range row {
+			for _, dir := range directions[:m.dirs] {
+				xx, yy, ok := neighbour(x, y, dir, p.Width(), p.Height(), wrap)
+				if ok && !m.Allows(tile, p[yy][xx], dir.x, dir.y) {
+					t.Fatalf("%v at (%d, %d) next to %v at (%d, %d) is not allowed", tile, x, y, p[yy][xx], xx, yy)
+				}
+			}
+		}
+	}
+}
+
+func TestGenerateAllows(t *testing.T) {
+	tests := []struct {
+		sample   string
+		opts     ModelOptions
+		periodic bool
+	}{
+		{"simple.txt", ModelOptions{}, false},
+		{"simple.txt", ModelOptions{Symmetry: Reverse, Diagonal: true}, false},
+		{"simple.txt", ModelOptions{Symmetry: Reverse}, true},
+		{"islands.txt", ModelOptions{N: 3, Symmetry: Mirror | Rotate}, false},
+		{"wilds.txt", ModelOptions{N: 3, Symmetry: Mirror}, false},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s/N=%d/diagonal=%v/periodic=%v", tt.sample, tt.opts.N, tt.opts.Diagonal, tt.periodic)
+		t.Run(name, func(t *testing.T) {
+			m, err := NewModel(loadTestSample(t, tt.sample), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := Generate(40, 24, Options{Model: m, Seed: 1, Periodic: tt.periodic, Attempts: 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Width() != 40 || p.Height() != 24 {
+				t.Fatalf("plane is %dx%d, want 40x24", p.Width(), p.Height())
+			}
+			checkAllows(t, m, p, tt.periodic)
+		})
+	}
+}
+
+func TestGenerateWorkers(t *testing.T) {
+	m, err := NewModel(loadTestSample(t, "islands.txt"), ModelOptions{N: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rejects about half the planes, whatever goroutine checks them
+	oddSea := func(p Plane) error {
+		sea := 0
+		for _, row := range p {
+			for _, tile := range row {
+				if tile == Sea {
+					sea++
+				}
+			}
+		}
+		if sea%2 == 0 {
+			return ErrRejected
+		}
+		return nil
+	}
+
+	rejected := 0
+	for seed := int64(1); seed <= 8; seed++ {
+		// one worker, so the count needs no lock
+		opts := Options{Model: m, Seed: seed, Attempts: 20, Workers: 1, Validators: []Validator{func(p Plane) error {
+			err := oddSea(p)
+			if err != nil {
+				rejected++
+			}
+			return err
+		}}}
+		want, err := Generate(24, 16, opts)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+
+		// the first attempts start late, so later ones finish before them
+		opts.Workers = 8
+		opts.Validators = []Validator{oddSea}
+		opts.Observer = func(st Step) {
+			if st.Kind == StepStart && st.Attempt < opts.Workers {
+				time.Sleep(time.Duration(opts.Workers-st.Attempt) * time.Millisecond)
+			}
+		}
+		got, err := Generate(24, 16, opts)
+		if err != nil {
+			t.Fatalf("seed %d with 8 workers: %v", seed, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("seed %d: 8 workers generated another plane than 1", seed)
+		}
+	}
+	if rejected == 0 {
+		t.Fatal("no plane was rejected")
+	}
+}
+
+func TestBacktrack(t *testing.T) {
+	m, err := NewModel(loadTestSample(t, "wilds.txt"), ModelOptions{N: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seeds that contradict without backtracking must be recovered with it
+	recovered := 0
+	for seed := int64(1); seed <= 8; seed++ {
+		_, err := Generate(24, 16, Options{Model: m, Seed: seed, MaxBacktracks: -1})
+		if err == nil {
+			continue
+		}
+		var ce *ContradictionError
+		if !errors.As(err, &ce) || ce.Backtracks != 0 {
+			t.Fatalf("seed %d without backtracking: got %v, want a contradiction after 0 backtracks", seed, err)
+		}
+
+		backtracks := 0
+		p, err := Generate(24, 16, Options{Model: m, Seed: seed, Observer: func(st Step) {
+			if st.Kind == StepBacktrack {
+				backtracks++
+			}
+		}})
+		if err != nil {
+			continue
+		}
+		if backtracks == 0 {
+			t.Errorf("seed %d recovered without backtracking", seed)
+		}
+		checkAllows(t, m, p, false)
+		recovered++
+	}
+	if recovered == 0 {
+		t.Fatal("no seed needed backtracking to recover")
+	}
+}
+
+func TestContradictionBacktracks(t *testing.T) {
+	// land and sea take turns, which an odd width cannot wrap around
+	m, err := NewModel(plane("LSLS", "SLSL", "LSLS", "SLSL"), ModelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		maxBacktracks int
+		want          int
+	}{
+		// the only decision is undone once before giving up
+		{0, 1},
+		{-1, 0},
+	}
+	for _, tt := range tests {
+		_, err := Generate(5, 4, Options{Model: m, Periodic: true, MaxBacktracks: tt.maxBacktracks})
+		var ce *ContradictionError
+		if !errors.As(err, &ce) {
+			t.Fatalf("MaxBacktracks %d: got %v, want a *ContradictionError", tt.maxBacktracks, err)
+		}
+		if ce.Backtracks != tt.want {
+			t.Errorf("MaxBacktracks %d: got %d backtracks, want %d", tt.maxBacktracks, ce.Backtracks, tt.want)
+		}
+	}
+}
+
+func TestUnsatisfiableConstraints(t *testing.T) {
+	m, err := NewModel(loadTestSample(t, "simple.txt"), ModelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		constraints []Constraint
+	}{
+		// the sample never puts land next to sea
+		{"land next to sea", []Constraint{Pin(3, 3, Land), Pin(4, 3, Sea)}},
+		{"tile not in the sample", []Constraint{Pin(3, 3, River)}},
+		{"land and sea on one cell", []Constraint{Rect(0, 0, 5, 5, Land), Pin(2, 2, Sea)}},
+	}
+	for _, tt := range tests {
+		collapsed := false
+		_, err := Generate(10, 10, Options{Model: m, Constraints: tt.constraints, Observer: func(st Step) {
+			if st.Kind == StepCollapse {
+				collapsed = true
+			}
+		}})
+		if !errors.Is(err, ErrContradiction) {
+			t.Errorf("%s: got %v, want ErrContradiction", tt.name, err)
+		}
+		if collapsed {
+			t.Errorf("%s: cells were collapsed before failing", tt.name)
+		}
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	simple, err := NewModel(loadTestSample(t, "simple.txt"), ModelOptions{Symmetry: Reverse})
+	if err != nil {
+		t.Fatal(err)
+	}
+	islands, err := NewModel(loadTestSample(t, "islands.txt"), ModelOptions{N: 3, Symmetry: Mirror | Rotate})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		m          *Model
+		periodic   bool
+		x, y, w, h int
+	}{
+		{"inside", islands, false, 12, 8, 10, 6},
+		{"top left corner", islands, false, 0, 0, 8, 6},
+		{"bottom right corner", islands, false, 30, 18, 10, 6},
+		{"whole plane", simple, false, 0, 0, 40, 24},
+		{"wrapped inside", islands, true, 12, 8, 10, 6},
+		{"wrapped across the corner", islands, true, 34, 20, 10, 8},
+		{"wrapped across the left edge", simple, true, -4, 5, 8, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Generate(40, 24, Options{Model: tt.m, Seed: 1, Periodic: tt.periodic, Attempts: 20})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a cell of the rectangle, in the coordinates of p
+			px, py := (tt.x+tt.w/2+40)%40, (tt.y+tt.h/2+24)%24
+			q, err := Regenerate(context.Background(), p, tt.x, tt.y, tt.w, tt.h, Options{
+				Model:       tt.m,
+				Seed:        2,
+				Periodic:    tt.periodic,
+				Attempts:    20,
+				Constraints: []Constraint{Pin(px, py, Land)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			inside := func(x, y int) bool {
+				if tt.periodic {
+					x, y = ((x-tt.x)%40+40)%40, ((y-tt.y)%24+24)%24
+				} else {
+					x, y = x-tt.x, y-tt.y
+				}
+				return x >= 0 && y >= 0 && x < tt.w && y < tt.h
+			}
+			for y, row := range q {
+				for x, tile := range row {
+					if !inside(x, y) && tile != p[y][x] {
+						t.Fatalf("(%d, %d) outside the rectangle changed from %v to %v", x, y, p[y][x], tile)
+					}
+				}
+			}
+			if q[py][px] != Land {
+				t.Errorf("(%d, %d) is %v, want it pinned to land", px, py, q[py][px])
+			}
+			checkAllows(t, tt.m, q, tt.periodic)
+		})
+	}
+}
+
+func TestRegenerateTooBig(t *testing.T) {
+	m, err := NewModel(loadTestSample(t, "islands.txt"), ModelOptions{N: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Generate(20, 12, Options{Model: m, Seed: 1, Attempts: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rectangle and its margin must fit in a periodic plane
+	if _, err := Regenerate(context.Background(), p, 0, 0, 18, 6, Options{Model: m, Periodic: true}); !errors.Is(err, ErrRegionTooBig) {
+		t.Errorf("got %v, want ErrRegionTooBig", err)
+	}
+	if _, err := Regenerate(context.Background(), p, 25, 0, 4, 4, Options{Model: m}); !errors.Is(err, ErrRegionTooBig) {
+		t.Errorf("got %v, want ErrRegionTooBig", err)
+	}
+}
+
+func TestReadSampleAlphabets(t *testing.T) {
+	tests := []struct {
+		text    string
+		read    func(io.Reader) (Plane, error)
+		wantErr bool
+	}{
+		{"LCS\nFRD\nWBL", ReadSample, false},
+		{"LtL\nLLL", ReadSample, true},
+		{".to\nsh.", ReadDecorations, false},
+		{".L.\n...", ReadDecorations, true},
+	}
+	for _, tt := range tests {
+		_, err := tt.read(strings.NewReader(tt.text))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.text, err, tt.wantErr)
+		}
+	}
+}
+
+// stringModel is the simple tiled model as it was before rules were
+// compiled into bitsets: every allowed pair is a key built with
+// fmt.Sprintf, kept to benchmark against.
+type stringModel struct {
+	tiles   []Tile
+	weights map[Tile]float64
+	rules   map[string]bool
+}
+
+func stringRuleKey(tile, other Tile, d v2) string {
+	return fmt.Sprintf("%c%c%d%d", tile, other, d.x, d.y)
+}
+
+func newStringModel(sample Plane) *stringModel {
+	m := &stringModel{weights: make(map[Tile]float64), rules: make(map[string]bool)}
+	for y, row := range sample {
+		for x, tile := range row {
+			if _, ok := m.weights[tile]; !ok {
+				m.tiles = append(m.tiles, tile)
+			}
+			m.weights[tile]++
+			for _, d := range directions[:orthogonal] {
+				xx, yy, ok := neighbour(x, y, d, sample.Width(), sample.Height(), false)
+				if ok {
+					m.rules[stringRuleKey(tile, sample[yy][xx], d)] = true
+				}
+			}
+		}
+	}
+	return m
+}
+
+type stringChange struct {
+	c   v2
+	old []Tile
+}
+
+type stringDecision struct {
+	c     v2
+	tile  Tile
+	trail int
+}
+
+// stringSolver is the solver as it was before the wave became a bitset:
+// a slice of options per cell, rescanned for the lowest entropy on every
+// step.
+type stringSolver struct {
+	m          *stringModel
+	rng        *rand.Rand
+	plane      [][][]Tile
+	trail      []stringChange
+	decisions  []stringDecision
+	backtracks int
+}
+
+func (s *stringSolver) set(c v2, options []Tile) {
+	s.trail = append(s.trail, stringChange{c, s.plane[c.y][c.x]})
+	s.plane[c.y][c.x] = options
+}
+
+func (s *stringSolver) undo(n int) {
+	for i := len(s.trail) - 1; i >= n; i-- {
+		ch := s.trail[i]
+		s.plane[ch.c.y][ch.c.x] = ch.old
+	}
+	s.trail = s.trail[:n]
+}
+
+func (s *stringSolver) lowestEntropy() (v2, bool) {
+	lowest, found := math.Inf(1), false
+	var coords v2
+	for y, row := range s.plane {
+		for x, options := range row {
+			if len(options) == 1 {
+				continue
+			}
+			sum, sumLog := 0.0, 0.0
+			for _, o := range options {
+				w := s.m.weights[o]
+				sum += w
+				sumLog += w * math.Log(w)
+			}
+			e := math.Log(sum) - sumLog/sum - s.rng.Float64()/1000
+			if e < lowest {
+				lowest, coords, found = e, v2{x, y}, true
+			}
+		}
+	}
+	return coords, found
+}
+
+func (s *stringSolver) collapse(c v2) {
+	options := s.plane[c.y][c.x]
+	total := 0.0
+	for _, o := range options {
+		total += s.m.weights[o]
+	}
+	total *= s.rng.Float64()
+	pick := options[0]
+	for _, o := range options {
+		if total -= s.m.weights[o]; total < 0 {
+			pick = o
+			break
+		}
+	}
+	s.decisions = append(s.decisions, stringDecision{c, pick, len(s.trail)})
+	s.set(c, []Tile{pick})
+}
+
+func (s *stringSolver) propagate(c v2) bool {
+	w, h := len(s.plane[0]), len(s.plane)
+	stack := []v2{c}
+	for len(stack) != 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		tiles := s.plane[cur.y][cur.x]
+		for _, d := range directions[:orthogonal] {
+			xx, yy, ok := neighbour(cur.x, cur.y, d, w, h, false)
+			if !ok {
+				continue
+			}
+			options := s.plane[yy][xx]
+			var keep []Tile
+			for _, other := range options {
+				for _, tile := range tiles {
+					if s.m.rules[stringRuleKey(tile, other, d)] {
+						keep = append(keep, other)
+						break
+					}
+				}
+			}
+			if len(keep) == len(options) {
+				continue
+			}
+			s.set(v2{xx, yy}, keep)
+			if len(keep) == 0 {
+				return false
+			}
+			stack = append(stack, v2{xx, yy})
+		}
+	}
+	return true
+}
+
+func (s *stringSolver) backtrack() bool {
+	for {
+		if s.backtracks >= DefaultMaxBacktracks || len(s.decisions) == 0 {
+			return false
+		}
+		s.backtracks++
+		d := s.decisions[len(s.decisions)-1]
+		s.decisions = s.decisions[:len(s.decisions)-1]
+		s.undo(d.trail)
+
+		var keep []Tile
+		for _, o := range s.plane[d.c.y][d.c.x] {
+			if o != d.tile {
+				keep = append(keep, o)
+			}
+		}
+		s.set(d.c, keep)
+		if len(keep) != 0 && s.propagate(d.c) {
+			return true
+		}
+	}
+}
+
+func generateStrings(m *stringModel, w, h int, seed int64) (Plane, error) {
+	s := &stringSolver{m: m, rng: rand.New(rand.NewSource(seed)), plane: make([][][]Tile, h)}
+	for y := range s.plane {
+		s.plane[y] = make([][]Tile, w)
+		for x := range s.plane[y] {
+			s.plane[y][x] = append([]Tile(nil), m.tiles...)
+		}
+	}
+	for c, ok := s.lowestEntropy(); ok; c, ok = s.lowestEntropy() {
+		s.collapse(c)
+		if !s.propagate(c) && !s.backtrack() {
+			return nil, ErrContradiction
+		}
+	}
+
+	out := make(Plane, h)
+	for y, row := range s.plane {
+		out[y] = make([]Tile, w)
+		for x, options := range row {
+			out[y][x] = options[0]
+		}
+	}
+	return out, nil
+}
+
+// BenchmarkGenerate compares the string keyed rules the generator started
+// with against the compiled bitsets, on the simple sample.
+func BenchmarkGenerate(b *testing.B) {
+	sample := loadTestSample(b, "simple.txt")
+	sm := newStringModel(sample)
+	m, err := NewModel(sample, ModelOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []struct{ w, h int }{{60, 33}, {120, 80}} {
+		b.Run(fmt.Sprintf("strings/%dx%d", size.w, size.h), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := generateStrings(sm, size.w, size.h, int64(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("bitsets/%dx%d", size.w, size.h), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Generate(size.w, size.h, Options{Model: m, Seed: int64(i)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// noisySample returns a w by h sample of random land, coast and sea, in
+// which every tile may be next to every other.
+func noisySample(w, h int, seed int64) Plane {
+	rng := rand.New(rand.NewSource(seed))
+	tiles := []Tile{Land, Coast, Sea}
+	p := make(Plane, h)
+	for y := range p {
+		p[y] = make([]Tile, w)
+		for x := range p[y] {
+			p[y][x] = tiles[rng.Intn(len(tiles))]
+		}
+	}
+	return p
+}
+
+// BenchmarkGenerateLarge measures the cost of picking the cell with the
+// lowest entropy as planes grow, with the overlapping model and with a
+// sample that never contradicts.
+func BenchmarkGenerateLarge(b *testing.B) {
+	islands, err := NewModel(loadTestSample(b, "islands.txt"), ModelOptions{N: 3, Symmetry: Mirror | Rotate})
+	if err != nil {
+		b.Fatal(err)
+	}
+	noisy, err := NewModel(noisySample(16, 16, 1), ModelOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name string
+		m    *Model
+		w, h int
+	}{
+		{"islands/60x33", islands, 60, 33},
+		{"islands/120x80", islands, 120, 80},
+		{"noisy/250x200", noisy, 250, 200},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Generate(bm.w, bm.h, Options{Model: bm.m, Seed: int64(i), Attempts: 10}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
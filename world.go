@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"runtime"
+	"time"
+
+	"snake/wfc"
+)
+
+// chunkSize is the side of the square chunks the endless world is made of
+const chunkSize = 16
+
+// chunkMargin is how many cells around a chunk are generated along with
+// it, and pinned to the chunks already there, so that it fits in with
+// them. The patterns of the overlapping styles reach two cells away.
+const chunkMargin = 2
+
+// a chunk is given chunkAttempts attempts and chunkTimeout for every way
+// of fitting it in, so that the snake doesn't wait on it for long
+const chunkAttempts = 20
+const chunkTimeout = 300 * time.Millisecond
+
+// maxChunks is how many chunks the world keeps before it drops the ones
+// far away from the snake
+const maxChunks = 256
+
+type chunk struct {
+	terrain     wfc.Plane
+	decorations wfc.Plane
+}
+
+// generatedChunk is a chunk generated in the background
+type generatedChunk struct {
+	key [2]int
+	c   *chunk
+}
+
+// world is the map of the endless mode. Its chunks are generated in the
+// background as the snake gets close to them, one at a time, so the
+// terrain of a seed depends on the way the snake took through it.
+type world struct {
+	seed    int64
+	terrain *levelTerrain
+	chunks  map[[2]int]*chunk
+	// busy is set while a chunk is being generated, done receives it
+	busy   bool
+	done   chan generatedChunk
+	cancel context.CancelFunc
+	ctx    context.Context
+	// spawn is where the snake starts, as {row, col}
+	spawn []int32
+}
+
+// newWorld generates the chunk the snake spawns in right away, the others
+// come in through prefetch.
+func newWorld(seed int64, t *levelTerrain) *world {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &world{
+		seed:    seed,
+		terrain: t,
+		chunks:  make(map[[2]int]*chunk),
+		done:    make(chan generatedChunk, 1),
+		cancel:  cancel,
+		ctx:     ctx,
+		spawn:   []int32{chunkSize / 2, chunkSize / 2},
+	}
+	w.chunks[[2]int{0, 0}] = w.chunk(0, 0, nil)
+	return w
+}
+
+// close stops the generation of the chunk in progress.
+func (w *world) close() {
+	w.cancel()
+}
+
+// floorDiv divides rounding towards negative infinity, so that cells left
+// of and above the origin fall in the chunks with negative coordinates
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return (a - b + 1) / b
+	}
+	return a / b
+}
+
+// chunkOf returns the chunk cell (x, y) is in and where in it.
+func chunkOf(x, y int) (cx, cy, i, j int) {
+	cx, cy = floorDiv(x, chunkSize), floorDiv(y, chunkSize)
+	return cx, cy, x - cx*chunkSize, y - cy*chunkSize
+}
+
+// ready reports whether the chunk of cell (x, y) has been generated.
+func (w *world) ready(x, y int) bool {
+	cx, cy, _, _ := chunkOf(x, y)
+	return w.chunks[[2]int{cx, cy}] != nil
+}
+
+// tile returns the terrain at cell (x, y). Cells whose chunk hasn't been
+// generated yet are Rock, so nothing is placed on them until it is.
+func (w *world) tile(x, y int) wfc.Tile {
+	cx, cy, i, j := chunkOf(x, y)
+	c := w.chunks[[2]int{cx, cy}]
+	if c == nil {
+		return wfc.Rock
+	}
+	return c.terrain[j][i]
+}
+
+// decoration returns the decoration at cell (x, y), Empty when the map
+// style has none or its chunk hasn't been generated yet.
+func (w *world) decoration(x, y int) wfc.Tile {
+	cx, cy, i, j := chunkOf(x, y)
+	c := w.chunks[[2]int{cx, cy}]
+	if c == nil || c.decorations == nil {
+		return wfc.Empty
+	}
+	return c.decorations[j][i]
+}
+
+// prefetch keeps the chunks covering the cells from (x0, y0) to (x1, y1)
+// coming. It is called every frame with the cells around the snake: it
+// adds the chunk generated since the last call, starts generating the
+// missing one nearest to the middle of the cells if none is in progress,
+// and drops the chunks far away from them once there are too many.
+func (w *world) prefetch(x0, y0, x1, y1 int) {
+	select {
+	case g := <-w.done:
+		w.chunks[g.key] = g.c
+		w.busy = false
+	default:
+	}
+
+	cx0, cy0, _, _ := chunkOf(x0, y0)
+	cx1, cy1, _, _ := chunkOf(x1, y1)
+	if len(w.chunks) > maxChunks {
+		for key := range w.chunks {
+			if key[0] < cx0-1 || key[0] > cx1+1 || key[1] < cy0-1 || key[1] > cy1+1 {
+				delete(w.chunks, key)
+			}
+		}
+	}
+	if w.busy {
+		return
+	}
+
+	mx, my := (cx0+cx1)/2, (cy0+cy1)/2
+	for r := 0; r <= max(cx1-cx0, cy1-cy0); r++ {
+		for cy := max(my-r, cy0); cy <= min(my+r, cy1); cy++ {
+			for cx := max(mx-r, cx0); cx <= min(mx+r, cx1); cx++ {
+				if w.chunks[[2]int{cx, cy}] == nil {
+					w.start(cx, cy)
+					return
+				}
+			}
+		}
+	}
+}
+
+// start generates chunk (cx, cy) in the background, fitting it in with
+// the chunks around it as they are now. Chunks never change once
+// generated, so the goroutine can hold on to them.
+func (w *world) start(cx, cy int) {
+	around := make(map[[2]int]*chunk)
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if c := w.chunks[[2]int{cx + dx, cy + dy}]; c != nil {
+				around[[2]int{cx + dx, cy + dy}] = c
+			}
+		}
+	}
+
+	w.busy = true
+	go func() {
+		g := generatedChunk{key: [2]int{cx, cy}, c: w.chunk(cx, cy, around)}
+		select {
+		case w.done <- g:
+		case <-w.ctx.Done():
+		}
+	}()
+}
+
+// chunk generates chunk (cx, cy) next to the chunks in around. When it
+// cannot be made to fit in with them, it is generated again pinning fewer
+// of their cells, and on its own as a last resort.
+func (w *world) chunk(cx, cy int, around map[[2]int]*chunk) *chunk {
+	var c *chunk
+	var err error
+	for pinned := chunkMargin; pinned >= 0; pinned-- {
+		if c, err = w.generate(cx, cy, pinned, around); err == nil {
+			return c
+		}
+		if w.ctx.Err() != nil {
+			break
+		}
+		log.Printf("seed %d: chunk (%d, %d) with %d pinned cells around: %v", w.seed, cx, cy, pinned, err)
+	}
+
+	c = &chunk{terrain: make(wfc.Plane, chunkSize)}
+	for j := range c.terrain {
+		c.terrain[j] = make([]wfc.Tile, chunkSize)
+		for i := range c.terrain[j] {
+			c.terrain[j][i] = wfc.Land
+		}
+	}
+	return c
+}
+
+// generate collapses chunk (cx, cy) along with a margin around it. The
+// cells of the margin that are in the chunks of around, and at most
+// pinned cells away from the chunk, are pinned to their tiles.
+func (w *world) generate(cx, cy, pinned int, around map[[2]int]*chunk) (*chunk, error) {
+	const size = chunkSize + 2*chunkMargin
+	rng := rand.New(rand.NewSource(w.seed ^ int64(cx)*73856093 ^ int64(cy)*19349663))
+
+	// neighbours calls f with the position in the margin of every cell
+	// to pin, and the chunk and position it is at in that chunk
+	neighbours := func(f func(i, j int, c *chunk, ci, cj int)) {
+		for j := chunkMargin - pinned; j < size-chunkMargin+pinned; j++ {
+			for i := chunkMargin - pinned; i < size-chunkMargin+pinned; i++ {
+				ncx, ncy, ci, cj := chunkOf(cx*chunkSize-chunkMargin+i, cy*chunkSize-chunkMargin+j)
+				if n := around[[2]int{ncx, ncy}]; n != nil {
+					f(i, j, n, ci, cj)
+				}
+			}
+		}
+	}
+
+	opts := wfc.Options{
+		Model:    w.terrain.model,
+		Seed:     rng.Int63(),
+		Attempts: chunkAttempts,
+		Workers:  runtime.NumCPU(),
+	}
+	neighbours(func(i, j int, c *chunk, ci, cj int) {
+		opts.Constraints = append(opts.Constraints, wfc.Pin(i, j, c.terrain[cj][ci]))
+	})
+	spawn := wfc.Rect(chunkMargin+chunkSize/2-spawnSize/2, chunkMargin+chunkSize/2-spawnSize/2, spawnSize, spawnSize, wfc.Land)
+	if cx == 0 && cy == 0 {
+		opts.Constraints = append(opts.Constraints, spawn)
+	}
+
+	ctx, cancel := context.WithTimeout(w.ctx, chunkTimeout)
+	defer cancel()
+	terrain, err := wfc.GenerateContext(ctx, size, size, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var decorations wfc.Plane
+	if w.terrain.decorations != nil {
+		opts.Model = w.terrain.decorations.Model
+		opts.Constraints = w.terrain.decorations.Constraints(terrain)
+		neighbours(func(i, j int, c *chunk, ci, cj int) {
+			if c.decorations != nil {
+				opts.Constraints = append(opts.Constraints, wfc.Pin(i, j, c.decorations[cj][ci]))
+			}
+		})
+		if cx == 0 && cy == 0 {
+			spawn.Tiles = []wfc.Tile{wfc.Empty}
+			opts.Constraints = append(opts.Constraints, spawn)
+		}
+		if decorations, err = wfc.GenerateContext(ctx, size, size, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// only the chunk itself is kept, its margin is generated again with
+	// the chunks around it
+	c := &chunk{terrain: crop(terrain)}
+	if decorations != nil {
+		c.decorations = crop(decorations)
+	}
+	return c, nil
+}
+
+func crop(p wfc.Plane) wfc.Plane {
+	out := make(wfc.Plane, chunkSize)
+	for j := range out {
+		out[j] = p[chunkMargin+j][chunkMargin : chunkMargin+chunkSize]
+	}
+	return out
+}